@@ -3,7 +3,10 @@ package lib
 import "fmt"
 import "net"
 import "os"
+import "strings"
+import "time"
 import "github.com/jmoiron/sqlx"
+import "github.com/go-sql-driver/mysql"
 import "github.com/DavidGamba/go-getoptions"
 import config "github.com/olebedev/config"
 
@@ -38,17 +41,142 @@ func IPversion (ip string) (string) {
 }
 
 func InitDatabase (dbh *sqlx.DB) (bool) {
-  tables := make([]string, 3)
+  tables := make([]string, 9)
   tables[0] = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS mirrors (mirror_id integer primary key %s, name text not null unique, basedir text, basedir_altarch text, http int, https int, rsync int, ipv4 int, ipv6 int, enabled text, continent text, country text, region text, longitude float, latitude float)`, DB_AutoInc(dbh.DriverName()) )
   tables[1] = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS repos (repo_id integer primary key %s, major_release integer, path text, name text, arch text, is_altarch integer, enabled integer)`, DB_AutoInc(dbh.DriverName()) )
   tables[2] = `CREATE TABLE IF NOT EXISTS status (mirror_id integer, repo_id int, timestamp integer, checked integer, result integer, primary key(mirror_id, repo_id) )`
+  tables[3] = `CREATE TABLE IF NOT EXISTS releases (major_release integer primary key, eol integer, vault text, vault_altarch text)`
+  tables[4] = `CREATE TABLE IF NOT EXISTS arches (alias varchar(64) primary key, arch text)`
+  tables[5] = `CREATE TABLE IF NOT EXISTS revisions (repo_id integer, timestamp integer, seen integer, primary key(repo_id, timestamp) )`
+  tables[6] = `CREATE TABLE IF NOT EXISTS status_history (mirror_id integer, repo_id integer, checked integer, result integer, latency integer, samples integer, successes integer)`
+  tables[7] = `CREATE TABLE IF NOT EXISTS vantage_status (mirror_id integer, repo_id integer, vantage varchar(64), timestamp integer NOT NULL DEFAULT 0, checked integer NOT NULL DEFAULT 0, result integer NOT NULL DEFAULT 0, lease_owner varchar(255) NOT NULL DEFAULT '', lease_expiry integer NOT NULL DEFAULT 0, primary key(mirror_id, repo_id, vantage) )`
+  tables[8] = `CREATE TABLE IF NOT EXISTS jobs (name varchar(64) primary key, owner varchar(255) NOT NULL DEFAULT '', expiry integer NOT NULL DEFAULT 0, last_run integer NOT NULL DEFAULT 0)`
 
   for _, table := range tables {
     _, execerr := dbh.Exec(table)
     if execerr != nil { return false }
   }
 
-  return true
+  return create_indexes(dbh) == nil
+}
+
+// status_history gets a row for every check, the history endpoints and the downsampling
+// read it by mirror and repo, the retention deletes by time
+var indexes = []string{
+  `CREATE INDEX status_history_mirror ON status_history (mirror_id, repo_id, checked)`,
+  `CREATE INDEX status_history_checked ON status_history (checked)`,
+}
+
+// MySQL has no CREATE INDEX IF NOT EXISTS, so existing indexes are skipped like existing columns
+func create_indexes (dbh *sqlx.DB) (error) {
+  for _, index := range indexes {
+    _, execerr := dbh.Exec(index)
+    if execerr != nil && !duplicate_index(execerr) {
+      return fmt.Errorf("%s: %s", index, execerr)
+    }
+  }
+
+  return nil
+}
+
+// Columns added after the initial table layout
+// Existing databases are upgraded by adding them, columns which exist already are skipped
+var columns = []string{
+  `ALTER TABLE mirrors ADD COLUMN infra varchar(255) NOT NULL DEFAULT ''`,
+  `ALTER TABLE repos ADD COLUMN reference varchar(255) NOT NULL DEFAULT ''`,
+  `ALTER TABLE status ADD COLUMN lag_seconds integer NOT NULL DEFAULT -1`,
+  `ALTER TABLE status ADD COLUMN behind integer NOT NULL DEFAULT -1`,
+  `ALTER TABLE status ADD COLUMN checksum varchar(64) NOT NULL DEFAULT ''`,
+  `ALTER TABLE status ADD COLUMN inconsistent integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE revisions ADD COLUMN checksum varchar(64) NOT NULL DEFAULT ''`,
+  `ALTER TABLE mirrors ADD COLUMN tls_version varchar(16) NOT NULL DEFAULT ''`,
+  `ALTER TABLE mirrors ADD COLUMN tls_error varchar(255) NOT NULL DEFAULT ''`,
+  `ALTER TABLE mirrors ADD COLUMN tls_checked integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN cert_expiry integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN rsync_path varchar(255) NOT NULL DEFAULT ''`,
+  `ALTER TABLE mirrors ADD COLUMN rsync_path_altarch varchar(255) NOT NULL DEFAULT ''`,
+  `ALTER TABLE mirrors ADD COLUMN rsync_checked integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE status ADD COLUMN rsync_timestamp integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE status ADD COLUMN rsync_result integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN auto_disabled integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN failures integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN successes integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN backoff integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN backoff_until integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE status ADD COLUMN priority integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN token varchar(64) NOT NULL DEFAULT ''`,
+  `ALTER TABLE mirrors ADD COLUMN reported integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE repos ADD COLUMN published integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE status ADD COLUMN lease_owner varchar(255) NOT NULL DEFAULT ''`,
+  `ALTER TABLE status ADD COLUMN lease_expiry integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN dns_time integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN connect_time integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN tls_time integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN ttfb integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN timings_checked integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN throughput integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN throughput_checked integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE status ADD COLUMN integrity integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE status ADD COLUMN integrity_checked integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE status ADD COLUMN etag varchar(255) NOT NULL DEFAULT ''`,
+  `ALTER TABLE status ADD COLUMN last_modified varchar(64) NOT NULL DEFAULT ''`,
+  `ALTER TABLE jobs ADD COLUMN progress integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE mirrors ADD COLUMN tls_failures integer NOT NULL DEFAULT 0`,
+  `ALTER TABLE repos ADD COLUMN published_at integer NOT NULL DEFAULT 0`,
+}
+
+// Returns the number of columns added, stops at the first error other than an existing column
+func UpgradeDatabase (dbh *sqlx.DB) (int, error) {
+  var added int
+
+  for _, column := range columns {
+    _, execerr := dbh.Exec(column)
+    if execerr == nil {
+      added++
+      continue
+    }
+    if !duplicate_column(execerr) {
+      return added, fmt.Errorf("%s: %s", column, execerr)
+    }
+  }
+
+  // Databases created before the indexes existed
+  return added, create_indexes(dbh)
+}
+
+// SQLite only reports the duplicate in the message, MySQL has error 1060 (ER_DUP_FIELDNAME)
+func duplicate_column (err error) (bool) {
+  if myerr, ok := err.(*mysql.MySQLError); ok { return myerr.Number == 1060 }
+  return strings.Contains(err.Error(), "duplicate column name")
+}
+
+// MySQL error 1061 is ER_DUP_KEYNAME
+func duplicate_index (err error) (bool) {
+  if myerr, ok := err.(*mysql.MySQLError); ok { return myerr.Number == 1061 }
+  return strings.Contains(err.Error(), "already exists")
+}
+
+// Marks a repo as published with the given repomd.xml timestamp and flags all its mirrors for a check
+// The time of the publish is kept separately, the compose may be much older than that
+// Returns false if the repo does not exist
+func PublishRepo (dbh *sqlx.DB, repoid int, timestamp int64) (bool, error) {
+  tx, err := dbh.Begin()
+  if err != nil { return false, err }
+
+  result, err := tx.Exec(`UPDATE repos SET published = ?, published_at = ? WHERE repo_id = ?`, timestamp, time.Now().Unix(), repoid)
+  if err == nil {
+    if updated, _ := result.RowsAffected(); updated == 0 {
+      _ = tx.Rollback()
+      return false, nil
+    }
+    _, err = tx.Exec(`UPDATE status SET priority = 1 WHERE repo_id = ?`, repoid)
+  }
+  if err != nil {
+    _ = tx.Rollback()
+    return true, err
+  }
+
+  return true, tx.Commit()
 }
 
 func TableCount (dbh *sqlx.DB, database string) (int) {
@@ -73,6 +201,13 @@ func DB_Random (dbtype string) (string) {
   return random
 }
 
+func DB_InsertIgnore (dbtype string) (string) {
+  var insert string
+  if dbtype == "sqlite3" { insert = "INSERT OR IGNORE" }
+  if dbtype == "mysql" { insert = "INSERT IGNORE" }
+  return insert
+}
+
 func Build_DSN (cfg *config.Config) (string, string) {
   var driver string
   var dsn string
@@ -92,6 +227,10 @@ func Build_DSN (cfg *config.Config) (string, string) {
       dsn = cfg.UString(`database.username`,``)+`:`+cfg.UString(`database.password`,``)+
             `@tcp(`+cfg.UString(`database.host`,``)+`:`+cfg.UString(`database.port`,`3306`)+`/`+cfg.UString(`database.name`,`mirrorlist`)
     }
+
+    // RowsAffected counts matching rows like SQLite does, not only those whose values changed
+    // Leases are claimed by an UPDATE and renewing one within the same second changes nothing
+    dsn += `?clientFoundRows=true`
   }
 
   return driver, dsn
@@ -101,6 +240,8 @@ func Config_path (input string) (string) {
   var configpath string = input
 
   opt := getoptions.New()
+  // Other options are read by the process itself
+  opt.SetUnknownMode("pass")
   opt.StringVar(&configpath, "config", input)
   _, err := opt.Parse(os.Args[1:])
 
@@ -10,6 +10,15 @@ type Location struct {
         Latitude        float64		// Currently unused
 }
 
+type ListRequest struct {
+	Release         string
+	Repo            string
+	Arch            string
+	Infra           string
+	Protocol        string		// http (default) or https
+	Format          string		// txt (default) or json
+}
+
 type Repo struct {
 	ID              int    `json:"id" db:"repo_id"`
 	MRelease        int    `json:"release" db:"major_release"`
@@ -18,6 +27,21 @@ type Repo struct {
 	Arch            string `json:"arch" db:"arch"`
 	Altarch         bool   `json:"is_altarch" db:"is_altarch"`
 	Enabled         bool   `json:"enabled" db:"enabled"`
+	Reference       string `json:"reference" db:"reference"`	// URL of the repo on the reference master, optional
+	Published       int64  `json:"published" db:"published"`	// repomd.xml timestamp of the latest publish, mirrors with older timestamps are behind
+	PublishedAt     int64  `json:"published_at" db:"published_at"`	// Time of the latest publish
+}
+
+type Release struct {
+	MRelease        int    `json:"release" db:"major_release"`
+	EOL             int64  `json:"eol" db:"eol"`			// Epoch, 0 if not end of life
+	Vault           string `json:"vault" db:"vault"`		// Base URL(s), separated by whitespace
+	VaultAlt        string `json:"vault_altarch" db:"vault_altarch"`
+}
+
+type Arch struct {
+	Alias           string `json:"alias" db:"alias"`		// Name used by clients (e.g. arm64)
+	Arch            string `json:"arch" db:"arch"`		// Name used in repos (e.g. aarch64)
 }
 
 type CacheStats struct {
@@ -43,6 +67,29 @@ type Mirror struct {
 	Latitude    float64 `json:"latitude" db:"latitude"`
 	Longitude   float64 `json:"longitude" db:"longitude"`
 	Enabled     bool    `json:"enabled" db:"enabled"`
+	Infra       string  `json:"infra" db:"infra"`		// Comma-separated, empty serves all clients
+	TLSVersion  string  `json:"tls_version" db:"tls_version"`
+	TLSError    string  `json:"tls_error" db:"tls_error"`
+	TLSChecked  int64   `json:"tls_checked" db:"tls_checked"`
+	TLSFailures int     `json:"tls_failures" db:"tls_failures"`		// Consecutive failed connections, see tls_loop
+	CertExpiry  int64   `json:"cert_expiry" db:"cert_expiry"`
+	RsyncPath   string  `json:"rsync_path" db:"rsync_path"`			// Module and path, defaults to basedir
+	RsyncPathAlt string `json:"rsync_path_altarch" db:"rsync_path_altarch"`	// Module and path, defaults to basedir_altarch
+	RsyncChecked int64  `json:"rsync_checked" db:"rsync_checked"`
+	AutoDisabled bool   `json:"auto_disabled" db:"auto_disabled"`	// Set by mirrorlist_updater after consecutive failures
+	Failures    int     `json:"failures" db:"failures"`		// Consecutive failed checks
+	Successes   int     `json:"successes" db:"successes"`		// Consecutive successful checks
+	Backoff     int64   `json:"backoff" db:"backoff"`
+	BackoffUntil int64  `json:"backoff_until" db:"backoff_until"`
+	Token       string  `json:"-" db:"token"`			// SHA256 of the token for /report
+	Reported    int64   `json:"reported" db:"reported"`
+	DNSTime     int64   `json:"dns_time" db:"dns_time"`			// Milliseconds, as measured by the last probe
+	ConnectTime int64   `json:"connect_time" db:"connect_time"`
+	TLSTime     int64   `json:"tls_time" db:"tls_time"`
+	TTFB        int64   `json:"ttfb" db:"ttfb"`
+	TimingsChecked int64 `json:"timings_checked" db:"timings_checked"`
+	Throughput  int64   `json:"throughput" db:"throughput"`		// Bytes per second, 0 if not measured
+	ThroughputChecked int64 `json:"throughput_checked" db:"throughput_checked"`
 }
 
 type Issue struct {
@@ -53,10 +100,20 @@ type Issue struct {
 type CheckTask struct {
         MirrorID        int
         RepoID          int
+        Host            string		// Name of the mirror, used to limit concurrent checks
         URL             string
         Iso             bool
         AltArch         bool
         Valid           bool
+        Timestamp       int64		// Result of the previous check, kept if repomd.xml has not changed
+        Checksum        string
+        Validators      Validators
+}
+
+// Response headers of repomd.xml, sent back to only download it when it has changed
+type Validators struct {
+        ETag            string
+        LastModified    string
 }
 
 type CheckResult struct {
@@ -64,4 +121,54 @@ type CheckResult struct {
         RepoID          int
         Timestamp       int64
         Result          int
+        Lag             int64		// Seconds behind the reference, -1 if unknown
+        Behind          int		// Revisions behind the reference, -1 if unknown
+        Checksum        string		// SHA256 of repomd.xml
+        Inconsistent    bool		// Checksum differs from the reference for the same timestamp
+        Checked         int64		// Time of the check
+        Latency         int64		// Duration of the check in milliseconds
+        Timings         Timings
+        Validators      Validators
+}
+
+// Phases of an HTTP probe in milliseconds, -1 if skipped (e.g. on a re-used connection)
+type Timings struct {
+        DNS             int64
+        Connect         int64
+        TLS             int64
+        TTFB            int64		// From sending the request to the first byte of the response
+}
+
+// Current state of a mirror's repo, as returned by ?wait=
+type CheckStatus struct {
+	MirrorID    int     `json:"mirror_id" db:"mirror_id"`
+	RepoID      int     `json:"repo_id" db:"repo_id"`
+	Timestamp   int64   `json:"timestamp" db:"timestamp"`
+	Checked     int64   `json:"checked" db:"checked"`
+	Result      int     `json:"result" db:"result"`
+}
+
+// One check of a mirror's repo, or several checks merged by downsampling
+type HistoryEntry struct {
+	RepoID      int     `json:"repo_id" db:"repo_id"`
+	Checked     int64   `json:"checked" db:"checked"`
+	Result      int     `json:"result" db:"result"`		// Last failed result if any check failed
+	Latency     int64   `json:"latency" db:"latency"`		// Average in milliseconds
+	Samples     int     `json:"samples" db:"samples"`
+	Successes   int     `json:"successes" db:"successes"`
+}
+
+type Uptime struct {
+	RepoID      int     `json:"repo_id,omitempty" db:"repo_id"`
+	Samples     int     `json:"samples" db:"samples"`
+	Successes   int     `json:"successes" db:"successes"`
+	Percent     float64 `json:"percent"`
+}
+
+type UptimeReport struct {
+	Name        string   `json:"name"`
+	Since       int64    `json:"since"`
+	Until       int64    `json:"until"`
+	Uptime
+	Repos       []Uptime `json:"repos"`
 }
@@ -5,6 +5,8 @@ import "log"
 import "net"
 import "net/http"
 import "regexp"
+import "strings"
+import "sync"
 
 // GeoIP dependencies
 import "github.com/oschwald/geoip2-golang"
@@ -14,8 +16,15 @@ import _ "github.com/mattn/go-sqlite3"
 import _ "github.com/go-sql-driver/mysql"
 
 // Used in /admin endpoints
+import "database/sql"
 import "encoding/json"
 
+// Tokens for /report
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/hex"
+
 // For repository checking
 import "strconv"
 import "time"
@@ -44,7 +53,15 @@ var rescache *freecache.Cache
 var listsize int
 var dbtype string
 var caching bool
+var certdays int
+var reportinterval int64
+var vantages map[string]string
+var vantagemaxage int64
+var slowttfb int64
 var headers map[string]string
+var infratags map[string]bool
+var infraloaded int64
+var infralock sync.Mutex
 
 // Main
 func main() {
@@ -69,6 +86,12 @@ func main() {
   defer geodb.Close()
   check_geodb_age()
 
+  // Certificates expiring within this number of days are reported as issue
+  certdays = cfg.UInt(`frontend.issues.cert-expiry-days`, 14)
+
+  // Mirrors may report a finished sync once within this number of seconds
+  reportinterval = int64(cfg.UInt(`frontend.report.min-interval`, 60))
+
   // Configure list size (number of mirrors in each response)
   listsize = cfg.UInt(`frontend.results`, 10)
 
@@ -80,6 +103,19 @@ func main() {
     headers[k] = convert_interface(v)
   }
 
+  // Map client continents to the updater vantage whose results apply to them
+  // Continents without a vantage use the results of the primary updater
+  vantages = make(map[string]string)
+  vantagemap, _ := cfg.Map(`frontend.vantages`)
+  for k, v := range(vantagemap) {
+    log.Printf("Using vantage \"%s\" for clients in %s\n", convert_interface(v), k)
+    vantages[k] = convert_interface(v)
+  }
+  vantagemaxage = int64(cfg.UInt(`frontend.vantage-max-age`, 14400))
+
+  // Mirrors responding slower than this (milliseconds) are only used to fill up the list, 0 disables it
+  slowttfb = int64(cfg.UInt(`frontend.slow-ttfb`, 2000))
+
   // Build DSN from config
   driver, dsn := lib.Build_DSN(cfg)
   log.Printf("Using %s with DSN %s\n", driver, dsn)
@@ -97,7 +133,7 @@ func main() {
   log.Printf("Database has %d tables\n", tablecount)
 
   // Init Database, if empty
-  if (tablecount < 3) {
+  if (tablecount < 9) {
     log.Println("Initializing database")
     success := lib.InitDatabase(mirrordb)
     if success {
@@ -105,6 +141,15 @@ func main() {
     }
   }
 
+  // Add columns introduced after the database was created
+  upgraded, err := lib.UpgradeDatabase(mirrordb)
+  if err != nil {
+    log.Fatal(err)
+  }
+  if upgraded > 0 {
+    log.Printf("Added %d column(s) to the database\n", upgraded)
+  }
+
   // Read cache configuration from config (default here is true, for performance)
   caching = cfg.UBool(`frontend.cache.enabled`, true)
 
@@ -124,8 +169,15 @@ func main() {
   // Set up http paths
   routes := router.New()
 
-  // Public endpoint, always active
+  // Public endpoints, always active
   routes.GET("/", http_handler_root)
+  routes.GET("/mirrorlist/{release}/{repo}/{arch}", http_handler_path)
+  routes.GET("/mirrorlist/{release}/{repo}/{arch}/{options:*}", http_handler_path)
+
+  // Sync notifications from mirrors, authenticated by their token
+  if cfg.UBool(`frontend.report.enabled`, true) {
+    routes.POST("/report", http_handler_report)
+  }
 
   // Register admin endpoints if enabled in configuration
   if cfg.UBool(`frontend.admin.read`) {
@@ -136,8 +188,14 @@ func main() {
      routes.GET("/admin/cache", http_handler_cache_get)
      // Mirrors
      routes.GET("/admin/mirrors", http_handler_mirror_get)
+     routes.GET("/admin/mirrors/{name}/history", http_handler_history_get)
+     routes.GET("/admin/mirrors/{name}/uptime", http_handler_uptime_get)
      // Repos
      routes.GET("/admin/repos", http_handler_repo_get)
+     // Releases
+     routes.GET("/admin/releases", http_handler_release_get)
+     // Architecture aliases
+     routes.GET("/admin/arches", http_handler_arch_get)
      // Operations
      routes.GET("/admin/issues", http_handler_issues)
   }
@@ -151,10 +209,22 @@ func main() {
      routes.POST("/admin/mirrors", http_handler_mirror_post)
      routes.PATCH("/admin/mirrors/{name}", http_handler_mirror_patch)
      routes.DELETE("/admin/mirrors/{name}", http_handler_mirror_delete)
+     routes.POST("/admin/mirrors/{name}/recheck", http_handler_mirror_recheck)
+     routes.POST("/admin/mirrors/{name}/token", http_handler_mirror_token)
      // Repos
      routes.POST("/admin/repos", http_handler_repo_post)
      routes.PATCH("/admin/repos/{id}", http_handler_repo_patch)
      routes.DELETE("/admin/repos/{id}", http_handler_repo_delete)
+     routes.POST("/admin/repos/{id}/recheck", http_handler_repo_recheck)
+     routes.POST("/admin/repos/{id}/publish", http_handler_repo_publish)
+     // Releases
+     routes.POST("/admin/releases", http_handler_release_post)
+     routes.PATCH("/admin/releases/{release}", http_handler_release_patch)
+     routes.DELETE("/admin/releases/{release}", http_handler_release_delete)
+     // Architecture aliases
+     routes.POST("/admin/arches", http_handler_arch_post)
+     routes.PATCH("/admin/arches/{alias}", http_handler_arch_patch)
+     routes.DELETE("/admin/arches/{alias}", http_handler_arch_delete)
   }
 
   // Start the web server
@@ -207,6 +277,65 @@ func http_handler_location (ctx *fasthttp.RequestCtx) {
 }
 
 func http_handler_root (ctx *fasthttp.RequestCtx) {
+  // Check for required parameters
+  // The CentOS version always produces 200 OK
+  // We produce 400 Bad Request instead, so that we can find it in the logs
+  for _, key := range []string{"arch", "release", "repo"} {
+    if (string(ctx.QueryArgs().Peek(key)) == "") {
+      set_headers(ctx)
+      ctx.SetStatusCode(http.StatusBadRequest)
+      _, werr := ctx.Write([]byte(fmt.Sprintf("%s not specified\n", key)))
+      if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+      return
+    }
+  }
+
+  serve_mirrorlist(ctx, lib.ListRequest{ Release: string(ctx.QueryArgs().Peek("release")),
+                                         Repo: string(ctx.QueryArgs().Peek("repo")),
+                                         Arch: string(ctx.QueryArgs().Peek("arch")),
+                                         Infra: string(ctx.QueryArgs().Peek("infra")),
+                                         Protocol: string(ctx.QueryArgs().Peek("protocol")),
+                                         Format: string(ctx.QueryArgs().Peek("format")) })
+}
+
+func http_handler_path (ctx *fasthttp.RequestCtx) {
+  req := lib.ListRequest{ Release: ctx.UserValue("release").(string),
+                          Repo: ctx.UserValue("repo").(string),
+                          Arch: ctx.UserValue("arch").(string),
+                          Infra: string(ctx.QueryArgs().Peek("infra")) }
+
+  // Optional suffixes select protocol and/or format
+  // Example: /mirrorlist/8/BaseOS/x86_64/https/json
+  if options, ok := ctx.UserValue("options").(string); ok {
+    for _, option := range strings.Split(options, "/") {
+      switch option {
+        case ``:
+          continue
+        case `http`, `https`:
+          req.Protocol = option
+        case `txt`, `json`:
+          req.Format = option
+        default:
+          set_headers(ctx)
+          ctx.SetStatusCode(http.StatusBadRequest)
+          _, werr := ctx.Write([]byte(fmt.Sprintf("Unknown option %s\n", option)))
+          if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+          return
+      }
+    }
+  }
+
+  serve_mirrorlist(ctx, req)
+}
+
+func set_headers (ctx *fasthttp.RequestCtx) {
+  // Set headers (configured in frontend.headers)
+  for header, value := range(headers) {
+    ctx.Response.Header.Set(header, value)
+  }
+}
+
+func serve_mirrorlist (ctx *fasthttp.RequestCtx, req lib.ListRequest) {
   // Start the clock to measure response time
   start := time.Now()
 
@@ -219,27 +348,59 @@ func http_handler_root (ctx *fasthttp.RequestCtx) {
   // Determine IPv4 / IPv6
   ipversion := lib.IPversion(clientip)
 
-  // Set headers (configured in frontend.headers)
-  for header, value := range(headers) {
-    ctx.Response.Header.Set(header, value)
+  set_headers(ctx)
+
+  // Protocol of the URLs, defaults to http
+  if req.Protocol == `` { req.Protocol = `http` }
+  if req.Protocol != `http` && req.Protocol != `https` {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    _, werr := ctx.Write([]byte("protocol must be http or https\n"))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
   }
 
-  // Check for required parameters
-  // The CentOS version always produces 200 OK
-  // We produce 400 Bad Request instead, so that we can find it in the logs
-  for _, key := range []string{"arch", "release", "repo"} {
-    if (string(ctx.QueryArgs().Peek(key)) == "") {
-      ctx.SetStatusCode(http.StatusBadRequest)
-      _, werr := ctx.Write([]byte(fmt.Sprintf("%s not specified\n", key)))
+  // Format of the response, defaults to plain text (one URL per line)
+  if req.Format == `` { req.Format = `txt` }
+  if req.Format != `txt` && req.Format != `json` {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    _, werr := ctx.Write([]byte("format must be txt or json\n"))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+  if req.Format == `json` { ctx.Response.Header.Set("Content-Type", "application/json") }
+
+  // Clients use different names for the same architecture (e.g. arm64 and aarch64)
+  arch := normalise_arch(req.Arch)
+  if arch != req.Arch {
+    log.Printf("Client %s used arch alias %s for %s\n", clientip, req.Arch, arch)
+  }
+
+  // Infrastructure the client runs on (e.g. stock, container, genclo), optional
+  // Unknown values get the same list as clients without infra, so they cannot fill the cache
+  infra := strings.ToLower(req.Infra)
+  if infra != `` && !known_infra(infra) { infra = `` }
+
+  // Releases past their end of life are served from the vault
+  eol, vault, vault_alt := get_release_eol(req.Release)
+  if eol {
+    repoid, repopath, is_altarch, _ := get_repo_id(req.Release, req.Repo, arch, false)
+    if is_altarch { vault = vault_alt }
+
+    if repoid <= 0 || vault == `` {
+      ctx.SetStatusCode(http.StatusNotFound)
+      _, werr := ctx.Write([]byte("Invalid release/repo/arch combination\n"))
       if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
       return
     }
+
+    ctx.Response.Header.Set("X-Processing-Time", time.Since(start).String() )
+    _, werr := ctx.Write(format_response(vault_urls(vault, repopath, req.Repo, arch), req.Format))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
   }
 
   // Check for a matching repo
-  repoid, repopath, is_altarch := get_repo_id(string(ctx.QueryArgs().Peek("release")),
-                                              string(ctx.QueryArgs().Peek("repo")),
-					      string(ctx.QueryArgs().Peek("arch")) )
+  repoid, repopath, is_altarch, published := get_repo_id(req.Release, req.Repo, arch, true)
 
   // repoid is an auto_increment field, so its value is at least 1
   if repoid <= 0 {
@@ -253,11 +414,15 @@ func http_handler_root (ctx *fasthttp.RequestCtx) {
   // Caching this would increase performance by about 10% but eats a bunch of RAM, not worth it
   clientloc := get_ip_location(clientip)
 
+  // The key for the cache consist of repository ID, infra, protocol, format and the client's location
+  // This way a client from the same location asking for the same repository will get the same answer
+  // The fields are separated, so that e.g. repo 1 with infra "2" does not collide with repo 12
+  // The published timestamp invalidates lists from before a publish, also when it was done by mirrorlist_updater
+  cachekey := fmt.Sprintf("%d\x00%d\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s", repoid, published, infra, req.Protocol, req.Format, ipversion, clientloc.Continent, clientloc.Country, clientloc.Region)
+
   // Check cache for ready-to-send response
   if (caching) {
-    // The key for the cache consist of repository ID and the client's location
-    // This way a client from the same location asking for the same repository will get the same answer
-    response, cachehit := rescache.Get([]byte(fmt.Sprintf("%d%s%s%s%s", repoid, ipversion, clientloc.Continent, clientloc.Country, clientloc.Region)))
+    response, cachehit := rescache.Get([]byte(cachekey))
 
     ctx.Response.Header.Set("X-Cache-Hit", strconv.FormatBool(cachehit == nil))
     if cachehit == nil {
@@ -269,19 +434,23 @@ func http_handler_root (ctx *fasthttp.RequestCtx) {
   }
 
   // Find mirrors with the repo
-  // Returns a slice of int with matching mirror IDs
-  allmirrors := mirrors_with_repo(repoid)
-  if len(allmirrors) == 0 {
+  // Returns slices of int with matching mirror IDs, split by whether they are usable or behind (or failing)
+  current_mirrors, behind_mirrors := mirrors_with_repo(repoid, req.Protocol, vantages[clientloc.Continent])
+  if len(current_mirrors) + len(behind_mirrors) == 0 {
     log.Printf("Found no mirrors for repo ID %d\n", repoid)
     ctx.SetStatusCode(http.StatusNotFound)
     return
   }
 
-  // Pick local servers, if we have more than we need
-  // Returns a sorted slice of int suitable for the client
-  mirrors := allmirrors
-  if len(allmirrors) > listsize {
-    mirrors = nearby_mirrors(clientloc, lib.IPversion(clientip), allmirrors, listsize)
+  // Mirrors which are behind only fill up the list
+  mirrors := select_mirrors(clientloc, lib.IPversion(clientip), infra, current_mirrors, listsize)
+  if len(mirrors) < listsize {
+    mirrors = append(mirrors, select_mirrors(clientloc, lib.IPversion(clientip), infra, behind_mirrors, listsize - len(mirrors))...)
+  }
+  if len(mirrors) == 0 {
+    log.Printf("Found no mirrors for repo ID %d and infra %s\n", repoid, infra)
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
   }
 
   // Warn if we don't have enough mirrors
@@ -294,11 +463,13 @@ func http_handler_root (ctx *fasthttp.RequestCtx) {
 
   // Write out server list
   // This takes the mirror list ([]int) and the repository information and builds full URLs
-  response := full_mirror_urls(mirrors,
-                               repopath,
-			       string(ctx.QueryArgs().Peek("repo")),
-			       string(ctx.QueryArgs().Peek("arch")),
-			       is_altarch)
+  response := format_response(full_mirror_urls(mirrors,
+                                               req.Protocol,
+                                               repopath,
+                                               req.Repo,
+                                               arch,
+                                               is_altarch),
+                              req.Format)
 
   // Send response to client
   _, werr := ctx.Write(response)
@@ -306,7 +477,6 @@ func http_handler_root (ctx *fasthttp.RequestCtx) {
 
   // Add response to cache, if enabled
   // Empty responses are possible, but we don't cache them because they are not useful
-  cachekey := fmt.Sprintf("%d%s%s%s%s", repoid, ipversion, clientloc.Continent, clientloc.Country, clientloc.Region)
   if caching && len(response) > 0 {
     cacheerr := rescache.Set([]byte(cachekey), response, 3600)
     if cacheerr != nil {
@@ -315,6 +485,104 @@ func http_handler_root (ctx *fasthttp.RequestCtx) {
   }
 }
 
+// Picks up to limit mirrors for the client
+func select_mirrors (clientloc lib.Location, ipversion string, infra string, allmirrors []int, limit int) ([]int) {
+  // Mirrors tagged with an infra only serve clients of that infra
+  // Mirrors matching the client's infra are picked first, untagged mirrors fill up the list
+  infra_mirrors, general_mirrors := split_infra_mirrors(allmirrors, infra)
+
+  // Pick local servers, if we have more than we need
+  // Returns a sorted slice of int suitable for the client
+  mirrors := infra_mirrors
+  if len(infra_mirrors) > limit {
+    mirrors = nearby_mirrors(clientloc, ipversion, infra_mirrors, limit)
+  }
+  if len(mirrors) < limit {
+    if len(general_mirrors) > limit - len(mirrors) {
+      general_mirrors = nearby_mirrors(clientloc, ipversion, general_mirrors, limit - len(mirrors))
+    }
+    mirrors = append(mirrors, general_mirrors...)
+  }
+
+  return mirrors
+}
+
+func split_infra_mirrors (mirrors []int, infra string) ([]int, []int) {
+  var matching []int
+  var general []int
+
+  q, args, err := sqlx.In(`SELECT mirror_id, infra FROM mirrors WHERE mirror_id IN (?)`, mirrors)
+  if err != nil {
+    log.Printf("split_infra_mirrors -> sqlx.in -> %s\n", err)
+    return matching, mirrors
+  }
+
+  rows, err2 := mirrordb.Query(q,args...)
+  if err2 != nil {
+    log.Printf("split_infra_mirrors -> query -> %s\n", err2)
+    return matching, mirrors
+  }
+  defer rows.Close()
+
+  tags := make(map[int]string)
+  for rows.Next() {
+    var id int
+    var tag string
+    _ = rows.Scan(&id, &tag)
+    tags[id] = tag
+  }
+
+  // Keep the order of the input (most up-to-date mirrors first)
+  for _, id := range mirrors {
+    if tags[id] == `` {
+      general = append(general, id)
+      continue
+    }
+
+    for _, tag := range strings.Split(tags[id], ",") {
+      if infra != `` && strings.ToLower(strings.TrimSpace(tag)) == infra {
+        matching = append(matching, id)
+        break
+      }
+    }
+  }
+
+  return matching, general
+}
+
+// Returns true if at least one mirror is tagged with the infra
+// The tags are kept in memory for a minute, as this runs for every request with infra= (also cache hits)
+func known_infra (infra string) (bool) {
+  infralock.Lock()
+  defer infralock.Unlock()
+
+  if time.Now().Unix() - infraloaded >= 60 {
+    var tags []string
+    err := mirrordb.Select(&tags, `SELECT infra FROM mirrors WHERE infra != ''`)
+    if err != nil {
+      log.Println(err)
+      return false
+    }
+
+    infratags = make(map[string]bool)
+    for _, list := range tags {
+      for _, tag := range strings.Split(list, ",") {
+        infratags[strings.ToLower(strings.TrimSpace(tag))] = true
+      }
+    }
+    infraloaded = time.Now().Unix()
+  }
+
+  return infratags[infra]
+}
+
+// Makes the next known_infra read the tags again, after mirrors were added, changed or deleted
+func reload_infra () {
+  infralock.Lock()
+  infraloaded = 0
+  infralock.Unlock()
+}
+
 func nearby_mirrors (loc lib.Location, ipversion string, mirrors []int, limit int) ([]int) {
   var result []int
 
@@ -424,9 +692,28 @@ func http_handler_mirror_patch (ctx *fasthttp.RequestCtx) {
 
   // Iterate over the map created from the POST'ed content and
   // run one UPDATE statement per key
+  // Values are bound as parameters, so that strings (e.g. {"infra":"stock"}) are quoted
   for column, value := range changes {
-    _, txerr = tx.Exec("UPDATE mirrors SET "+column+" = "+convert_interface(value)+" WHERE mirror_id = "+strconv.Itoa(mirror_id))
-    if txerr != nil { log.Println("UPDATE to mirrors table failed") }
+    _, txerr = tx.Exec("UPDATE mirrors SET "+column+" = ? WHERE mirror_id = ?", value, mirror_id)
+    if txerr != nil {
+      log.Printf("UPDATE to mirrors table failed: %s\n", txerr.Error())
+      break
+    }
+  }
+
+  // The URLs may have changed, so the next checks download repomd.xml again
+  if txerr == nil {
+    _, txerr = tx.Exec(`UPDATE status SET etag = '', last_modified = '' WHERE mirror_id = ?`, mirror_id)
+    if txerr != nil { log.Printf("UPDATE to status table failed: %s\n", txerr.Error()) }
+  }
+
+  // Nothing is changed if one of the statements failed (e.g. an unknown column)
+  if txerr != nil {
+    _ = tx.Rollback()
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(txerr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
   }
 
   // Commit transaction and check for success
@@ -439,6 +726,7 @@ func http_handler_mirror_patch (ctx *fasthttp.RequestCtx) {
   }
 
   // Report success (204 No Content)
+  reload_infra()
   log.Printf("Updated mirror %s (ID %d)\n", ctx.UserValue("name"), mirror_id)
   ctx.SetStatusCode(http.StatusNoContent)
 }
@@ -465,6 +753,10 @@ func http_handler_mirror_delete (ctx *fasthttp.RequestCtx) {
   if txerr != nil { log.Println("Failed to DELETE from mirrors table") }
   _, txerr = tx.Exec("DELETE FROM status WHERE mirror_id = "+strconv.Itoa(mirror_id))
   if txerr != nil { log.Println("Failed to DELETE from status table") }
+  _, txerr = tx.Exec("DELETE FROM status_history WHERE mirror_id = "+strconv.Itoa(mirror_id))
+  if txerr != nil { log.Println("Failed to DELETE from status_history table") }
+  _, txerr = tx.Exec("DELETE FROM vantage_status WHERE mirror_id = "+strconv.Itoa(mirror_id))
+  if txerr != nil { log.Println("Failed to DELETE from vantage_status table") }
 
   // Commit transaction and check for success
   txerr = tx.Commit()
@@ -476,6 +768,7 @@ func http_handler_mirror_delete (ctx *fasthttp.RequestCtx) {
   }
 
   // On success, return `204 No content`
+  reload_infra()
   log.Printf("Deleted mirror %s (ID %d)\n", ctx.UserValue("name"), mirror_id)
   ctx.SetStatusCode(http.StatusNoContent)
 }
@@ -536,6 +829,127 @@ func http_handler_mirror_get (ctx *fasthttp.RequestCtx) {
   if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
 }
 
+// Returns the check history of a mirror, optionally limited to a repo (?repo=)
+// The period is given as ?since= and ?until= (Unix time) and defaults to the last 7 days
+func http_handler_history_get (ctx *fasthttp.RequestCtx) {
+  mirror_id, exists := mirror_name_to_id(ctx.UserValue("name").(string))
+  if !exists {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  since, until, valid := history_period(ctx, 7)
+  if !valid {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    return
+  }
+
+  query := `SELECT repo_id, checked, result, latency, samples, successes FROM status_history WHERE mirror_id = ? AND checked >= ? AND checked < ?`
+  args := []interface{}{mirror_id, since, until}
+  if len(ctx.QueryArgs().Peek("repo")) > 0 {
+    repo_id, converr := strconv.Atoi(string(ctx.QueryArgs().Peek("repo")))
+    if converr != nil {
+      ctx.SetStatusCode(http.StatusBadRequest)
+      return
+    }
+    query += ` AND repo_id = ?`
+    args = append(args, repo_id)
+  }
+
+  entries := []lib.HistoryEntry{}
+  err := mirrordb.Select(&entries, query + ` ORDER BY checked ASC, repo_id ASC`, args...)
+  if err != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(err.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  result, jsonerr := json.Marshal(entries)
+  if jsonerr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(jsonerr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  ctx.SetStatusCode(http.StatusOK)
+  ctx.Response.Header.Set("Content-Type", "application/json")
+  _, werr := ctx.Write(result)
+  if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+}
+
+// Returns the share of successful checks of a mirror, in total and per repo
+// The period is given as ?since= and ?until= (Unix time) and defaults to the last 30 days
+func http_handler_uptime_get (ctx *fasthttp.RequestCtx) {
+  mirror_id, exists := mirror_name_to_id(ctx.UserValue("name").(string))
+  if !exists {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  since, until, valid := history_period(ctx, 30)
+  if !valid {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    return
+  }
+
+  report := lib.UptimeReport{ Name: ctx.UserValue("name").(string), Since: since, Until: until, Repos: []lib.Uptime{} }
+  err := mirrordb.Select(&report.Repos, `SELECT repo_id, SUM(samples) AS samples, SUM(successes) AS successes FROM status_history
+                                         WHERE mirror_id = ? AND checked >= ? AND checked < ? GROUP BY repo_id ORDER BY repo_id`,
+                         mirror_id, since, until)
+  if err != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(err.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  for i := range report.Repos {
+    report.Repos[i].Percent = uptime_percent(report.Repos[i].Successes, report.Repos[i].Samples)
+    report.Samples += report.Repos[i].Samples
+    report.Successes += report.Repos[i].Successes
+  }
+  report.Percent = uptime_percent(report.Successes, report.Samples)
+
+  result, jsonerr := json.Marshal(report)
+  if jsonerr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(jsonerr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  ctx.SetStatusCode(http.StatusOK)
+  ctx.Response.Header.Set("Content-Type", "application/json")
+  _, werr := ctx.Write(result)
+  if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+}
+
+// Reads ?since= and ?until=, the default is the given number of days until now
+func history_period (ctx *fasthttp.RequestCtx, days int64) (int64, int64, bool) {
+  until := time.Now().Unix()
+  since := until - days * 86400
+
+  var err error
+  if len(ctx.QueryArgs().Peek("until")) > 0 {
+    until, err = strconv.ParseInt(string(ctx.QueryArgs().Peek("until")), 10, 64)
+    if err != nil { return 0, 0, false }
+    since = until - days * 86400
+  }
+  if len(ctx.QueryArgs().Peek("since")) > 0 {
+    since, err = strconv.ParseInt(string(ctx.QueryArgs().Peek("since")), 10, 64)
+    if err != nil { return 0, 0, false }
+  }
+
+  return since, until, since < until
+}
+
+func uptime_percent (successes int, samples int) (float64) {
+  if samples == 0 { return 0 }
+  return float64(successes) * 100 / float64(samples)
+}
+
 func http_handler_repo_post (ctx *fasthttp.RequestCtx) {
   var newrepo lib.Repo
   // Read POST'ed data (in JSON format)
@@ -559,9 +973,9 @@ func http_handler_repo_post (ctx *fasthttp.RequestCtx) {
   }
 
   stmt1, dberr := mirrordb.Prepare(`INSERT INTO repos
-                                    (major_release, name, path, arch, is_altarch, enabled)
+                                    (major_release, name, path, arch, is_altarch, enabled, reference)
 	                            VALUES
-	 			    (?, ?, ?, ?, ?, ?)`)
+	 			    (?, ?, ?, ?, ?, ?, ?)`)
   if dberr != nil {
     log.Printf("Prepare failed: %s\n", dberr.Error())
     ctx.SetStatusCode(http.StatusInternalServerError)
@@ -570,7 +984,7 @@ func http_handler_repo_post (ctx *fasthttp.RequestCtx) {
   }
 
   // INSERT new repo into database
-  _, dberr = stmt1.Exec(newrepo.MRelease, newrepo.Name, newrepo.Path, newrepo.Arch, newrepo.Altarch, newrepo.Enabled)
+  _, dberr = stmt1.Exec(newrepo.MRelease, newrepo.Name, newrepo.Path, newrepo.Arch, newrepo.Altarch, newrepo.Enabled, newrepo.Reference)
 
   if dberr != nil {
     ctx.SetStatusCode(http.StatusInternalServerError)
@@ -607,7 +1021,7 @@ func http_handler_repo_post (ctx *fasthttp.RequestCtx) {
   for _, mirror := range mirrors {
     if (mirror.Basedir != `` && !newrepo.Altarch) ||
        (mirror.BasedirAlt != `` && newrepo.Altarch) {
-      _, txerr = tx.Exec("INSERT INTO status (mirror_id, repo_id, checked) VALUES ("+strconv.Itoa(mirror.ID)+","+strconv.Itoa(newrepo.ID)+",0)")
+      _, txerr = tx.Exec("INSERT INTO status (mirror_id, repo_id, checked, priority) VALUES ("+strconv.Itoa(mirror.ID)+","+strconv.Itoa(newrepo.ID)+",0,1)")
       if txerr != nil { log.Println("Failed to INSERT into status table") }
     }
   }
@@ -622,7 +1036,7 @@ func http_handler_repo_post (ctx *fasthttp.RequestCtx) {
   }
 
   log.Printf("Created repo ID %d\n", newrepo.ID)
-  ctx.SetStatusCode(http.StatusCreated)
+  respond_after_checks(ctx, http.StatusCreated, `repo_id`, newrepo.ID)
 }
 
 func http_handler_repo_patch (ctx *fasthttp.RequestCtx) {
@@ -661,9 +1075,28 @@ func http_handler_repo_patch (ctx *fasthttp.RequestCtx) {
 
   // Iterate over the map created from the POST'ed content and
   // run one UPDATE statement per key
+  // Values are bound as parameters, so that strings (e.g. {"reference":"https://..."}) are quoted
   for column, value := range changes {
-    _, txerr = tx.Exec("UPDATE repos SET "+column+" = "+convert_interface(value)+" WHERE repo_id = "+repo_id)
-    if txerr != nil { log.Println("Failed to UPDATE repos table") }
+    _, txerr = tx.Exec("UPDATE repos SET "+column+" = ? WHERE repo_id = ?", value, repo_id)
+    if txerr != nil {
+      log.Printf("Failed to UPDATE repos table: %s\n", txerr.Error())
+      break
+    }
+  }
+
+  // The URLs may have changed, so the next checks download repomd.xml again
+  if txerr == nil {
+    _, txerr = tx.Exec(`UPDATE status SET etag = '', last_modified = '' WHERE repo_id = ?`, repo_id)
+    if txerr != nil { log.Printf("Failed to UPDATE status table: %s\n", txerr.Error()) }
+  }
+
+  // Nothing is changed if one of the statements failed (e.g. an unknown column)
+  if txerr != nil {
+    _ = tx.Rollback()
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(txerr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
   }
 
   // Commit transaction and check for success
@@ -710,6 +1143,10 @@ func http_handler_repo_delete (ctx *fasthttp.RequestCtx) {
   if txerr != nil { log.Println("Failed to DELETE from repos table") }
   _, txerr = tx.Exec("DELETE FROM status WHERE repo_id = "+repo_id)
   if txerr != nil { log.Println("Failed to DELETE from status table") }
+  _, txerr = tx.Exec("DELETE FROM status_history WHERE repo_id = "+repo_id)
+  if txerr != nil { log.Println("Failed to DELETE from status_history table") }
+  _, txerr = tx.Exec("DELETE FROM vantage_status WHERE repo_id = "+repo_id)
+  if txerr != nil { log.Println("Failed to DELETE from vantage_status table") }
 
   // Commit transaction and check for success
   txerr = tx.Commit()
@@ -725,56 +1162,369 @@ func http_handler_repo_delete (ctx *fasthttp.RequestCtx) {
   ctx.SetStatusCode(http.StatusNoContent)
 }
 
-func http_handler_mirror_post (ctx *fasthttp.RequestCtx) {
-  var newmirror lib.Mirror
-  // Read POST'ed data (in JSON format)
-  err := json.Unmarshal(ctx.PostBody(), &newmirror)
+func http_handler_release_get (ctx *fasthttp.RequestCtx) {
+  all, err := releaselist()
   if err != nil {
-    ctx.SetStatusCode(http.StatusBadRequest)
+    ctx.SetStatusCode(http.StatusInternalServerError)
     _, werr := ctx.Write([]byte(err.Error()))
     if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
     return
   }
 
-  // `name` and at least one of `basedir` or `basedir_alt` needs to be set
-  // It's possible for a mirror to have both, basedir and basedir_altarch
-  if (newmirror.Name == ``) || (newmirror.Basedir + newmirror.BasedirAlt == ``) {
-    ctx.SetStatusCode(http.StatusBadRequest)
-    _, werr := ctx.Write([]byte("Required parameters: name, basedir and/or basedir_altarch"))
-    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+  if len(all) == 0 {
+    ctx.SetStatusCode(http.StatusNoContent)
     return
   }
 
-  // Check if mirror with this name already exists
-  _, exists := mirror_name_to_id(newmirror.Name)
-  if exists {
-    ctx.SetStatusCode(http.StatusConflict)
+  result, jsonerr := json.Marshal(all)
+  if jsonerr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(jsonerr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
     return
   }
 
-  // Determine IPv4 and IPv6 support based on DNS
-  // A record == IPv4
-  // AAAA record == IPv6
-  ipfamilies := lib.IPfamilies(newmirror.Name)
-
-  // Get location of the mirror from GeoIP database
-  loc := get_ip_location(lib.Name_to_ip(newmirror.Name).String())
+  ctx.SetStatusCode(http.StatusOK)
+  ctx.Response.Header.Set("Content-Type", "application/json")
+  _, werr := ctx.Write(result)
+  if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+}
 
-  // Prepare INSERT
-  stmt1, err := mirrordb.Prepare(`INSERT INTO mirrors
-                                  (mirror_id, name, basedir, basedir_altarch, http, https, rsync, ipv4, ipv6, enabled,
-				   continent, country, region, longitude, latitude)
-                                  VALUES
-                                  (null, ?, ?, ?, 1, 1, 1, ?, ?, ?, ?, ?, ?, ?, ?)`)
+func http_handler_release_post (ctx *fasthttp.RequestCtx) {
+  var newrelease lib.Release
+  // Read POST'ed data (in JSON format)
+  err := json.Unmarshal(ctx.PostBody(), &newrelease)
   if err != nil {
-    log.Print(err)
+    ctx.SetStatusCode(http.StatusBadRequest)
+    _, werr := ctx.Write([]byte(err.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
     return
   }
 
-  // INSERT new mirror into database
-  _, err = stmt1.Exec(newmirror.Name, newmirror.Basedir, newmirror.BasedirAlt,
-                      ipfamilies[4], ipfamilies[6], lib.Bool_to_int(newmirror.Enabled),
-                      loc.Continent, loc.Country, loc.Region, loc.Longitude, loc.Latitude)
+  // Check for required parameters
+  if newrelease.MRelease == 0 {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    _, werr := ctx.Write([]byte("Required parameters: release"))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // Check if the release already exists
+  releases, _ := releaselist()
+  for _, release := range releases {
+    if release.MRelease == newrelease.MRelease {
+      ctx.SetStatusCode(http.StatusConflict)
+      return
+    }
+  }
+
+  stmt1, dberr := mirrordb.Prepare(`INSERT INTO releases (major_release, eol, vault, vault_altarch) VALUES (?, ?, ?, ?)`)
+  if dberr != nil {
+    log.Printf("Prepare failed: %s\n", dberr.Error())
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(dberr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // INSERT new release into database
+  _, dberr = stmt1.Exec(newrelease.MRelease, newrelease.EOL, newrelease.Vault, newrelease.VaultAlt)
+  if dberr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(dberr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  log.Printf("Created release %d\n", newrelease.MRelease)
+  ctx.SetStatusCode(http.StatusCreated)
+}
+
+func http_handler_release_patch (ctx *fasthttp.RequestCtx) {
+  release := ctx.UserValue("release").(string)
+
+  // Check if release exists
+  var exists bool = false
+  releases, _ := releaselist()
+  for _, r := range releases {
+    if (strconv.Itoa(r.MRelease) == release) {
+      exists = true
+    }
+  }
+  if !exists {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  // Decode JSON into a map of interfaces
+  // Example: {"eol":1719792000} -> eol:1719792000
+  changes := make(map[string]interface{})
+  err := json.Unmarshal(ctx.PostBody(), &changes)
+  if err != nil {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    return
+  }
+
+  // Begin transaction to make one or possibly multiple changes
+  tx, txerr := mirrordb.Begin()
+  if txerr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(txerr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // Iterate over the map created from the POST'ed content and
+  // run one UPDATE statement per key
+  for column, value := range changes {
+    _, txerr = tx.Exec("UPDATE releases SET "+column+" = ? WHERE major_release = "+release, value)
+    if txerr != nil { log.Println("Failed to UPDATE releases table") }
+  }
+
+  // Commit transaction and check for success
+  txerr = tx.Commit()
+  if txerr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(txerr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // Report success (204 No Content)
+  log.Printf("Updated release %s\n", release)
+  ctx.SetStatusCode(http.StatusNoContent)
+}
+
+func http_handler_release_delete (ctx *fasthttp.RequestCtx) {
+  release := ctx.UserValue("release").(string)
+
+  // Check if release exists
+  var exists bool = false
+  releases, _ := releaselist()
+  for _, r := range releases {
+    if (strconv.Itoa(r.MRelease) == release) {
+      exists = true
+    }
+  }
+  if !exists {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  _, dberr := mirrordb.Exec("DELETE FROM releases WHERE major_release = "+release)
+  if dberr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(dberr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // On success, return `204 No content`
+  log.Printf("Deleted release %s\n", release)
+  ctx.SetStatusCode(http.StatusNoContent)
+}
+
+func http_handler_arch_get (ctx *fasthttp.RequestCtx) {
+  all, err := archlist()
+  if err != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(err.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  if len(all) == 0 {
+    ctx.SetStatusCode(http.StatusNoContent)
+    return
+  }
+
+  result, jsonerr := json.Marshal(all)
+  if jsonerr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(jsonerr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  ctx.SetStatusCode(http.StatusOK)
+  ctx.Response.Header.Set("Content-Type", "application/json")
+  _, werr := ctx.Write(result)
+  if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+}
+
+func http_handler_arch_post (ctx *fasthttp.RequestCtx) {
+  var newarch lib.Arch
+  // Read POST'ed data (in JSON format)
+  err := json.Unmarshal(ctx.PostBody(), &newarch)
+  if err != nil {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    _, werr := ctx.Write([]byte(err.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // Check for required parameters
+  if newarch.Alias == `` || newarch.Arch == `` {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    _, werr := ctx.Write([]byte("Required parameters: alias, arch"))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // Check if the alias already exists
+  exists, dberr := arch_alias_exists(newarch.Alias)
+  if dberr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(dberr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+  if exists {
+    ctx.SetStatusCode(http.StatusConflict)
+    return
+  }
+
+  stmt1, dberr := mirrordb.Prepare(`INSERT INTO arches (alias, arch) VALUES (?, ?)`)
+  if dberr != nil {
+    log.Printf("Prepare failed: %s\n", dberr.Error())
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(dberr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // INSERT new alias into database
+  _, dberr = stmt1.Exec(newarch.Alias, newarch.Arch)
+  if dberr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(dberr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  log.Printf("Created arch alias %s for %s\n", newarch.Alias, newarch.Arch)
+  ctx.SetStatusCode(http.StatusCreated)
+}
+
+func http_handler_arch_patch (ctx *fasthttp.RequestCtx) {
+  alias := ctx.UserValue("alias").(string)
+
+  // Check if alias exists
+  exists, dberr := arch_alias_exists(alias)
+  if dberr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(dberr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+  if !exists {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  // Only the target architecture can be changed
+  // Example: {"arch":"aarch64"}
+  var changes lib.Arch
+  err := json.Unmarshal(ctx.PostBody(), &changes)
+  if err != nil || changes.Arch == `` {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    return
+  }
+
+  _, dberr = mirrordb.Exec(`UPDATE arches SET arch = ? WHERE alias = ?`, changes.Arch, alias)
+  if dberr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(dberr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // Report success (204 No Content)
+  log.Printf("Updated arch alias %s\n", alias)
+  ctx.SetStatusCode(http.StatusNoContent)
+}
+
+func http_handler_arch_delete (ctx *fasthttp.RequestCtx) {
+  alias := ctx.UserValue("alias").(string)
+
+  // Check if alias exists
+  exists, dberr := arch_alias_exists(alias)
+  if dberr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(dberr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+  if !exists {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  _, dberr = mirrordb.Exec(`DELETE FROM arches WHERE alias = ?`, alias)
+  if dberr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(dberr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // On success, return `204 No content`
+  log.Printf("Deleted arch alias %s\n", alias)
+  ctx.SetStatusCode(http.StatusNoContent)
+}
+
+func http_handler_mirror_post (ctx *fasthttp.RequestCtx) {
+  var newmirror lib.Mirror
+  // Read POST'ed data (in JSON format)
+  err := json.Unmarshal(ctx.PostBody(), &newmirror)
+  if err != nil {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    _, werr := ctx.Write([]byte(err.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // `name` and at least one of `basedir` or `basedir_alt` needs to be set
+  // It's possible for a mirror to have both, basedir and basedir_altarch
+  if (newmirror.Name == ``) || (newmirror.Basedir + newmirror.BasedirAlt == ``) {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    _, werr := ctx.Write([]byte("Required parameters: name, basedir and/or basedir_altarch"))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  // Check if mirror with this name already exists
+  _, exists := mirror_name_to_id(newmirror.Name)
+  if exists {
+    ctx.SetStatusCode(http.StatusConflict)
+    return
+  }
+
+  // Determine IPv4 and IPv6 support based on DNS
+  // A record == IPv4
+  // AAAA record == IPv6
+  ipfamilies := lib.IPfamilies(newmirror.Name)
+
+  // Get location of the mirror from GeoIP database
+  loc := get_ip_location(lib.Name_to_ip(newmirror.Name).String())
+
+  // Prepare INSERT
+  // HTTPS and rsync are enabled by mirrorlist_updater once they have been verified
+  stmt1, err := mirrordb.Prepare(`INSERT INTO mirrors
+                                  (mirror_id, name, basedir, basedir_altarch, http, https, rsync, ipv4, ipv6, enabled,
+				   continent, country, region, longitude, latitude, infra, rsync_path, rsync_path_altarch)
+                                  VALUES
+                                  (null, ?, ?, ?, 1, 0, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+  if err != nil {
+    log.Print(err)
+    return
+  }
+
+  // INSERT new mirror into database
+  _, err = stmt1.Exec(newmirror.Name, newmirror.Basedir, newmirror.BasedirAlt,
+                      ipfamilies[4], ipfamilies[6], lib.Bool_to_int(newmirror.Enabled),
+                      loc.Continent, loc.Country, loc.Region, loc.Longitude, loc.Latitude, newmirror.Infra,
+                      newmirror.RsyncPath, newmirror.RsyncPathAlt)
   if err == nil {
     // We could use LastInsertId here, but that is not supported by all database drivers
     newmirror.ID, _ = mirror_name_to_id(newmirror.Name)
@@ -788,6 +1538,9 @@ func http_handler_mirror_post (ctx *fasthttp.RequestCtx) {
     return
   }
 
+  // Clients may use the new mirror's infra right away
+  reload_infra()
+
   // Add the new mirror and its supported repositories to the `status` table
   // mirrorlist_updater will start checking the repositories and the mirror
   // will be considered in the selection process
@@ -806,7 +1559,7 @@ func http_handler_mirror_post (ctx *fasthttp.RequestCtx) {
   for _, repo := range repos {
     if (newmirror.Basedir != `` && !repo.Altarch && repo.Enabled) ||
        (newmirror.BasedirAlt != `` && repo.Altarch && repo.Enabled) {
-      _, txerr = tx.Exec("INSERT INTO status (mirror_id, repo_id, checked) VALUES ("+strconv.Itoa(newmirror.ID)+","+strconv.Itoa(repo.ID)+",0)")
+      _, txerr = tx.Exec("INSERT INTO status (mirror_id, repo_id, checked, priority) VALUES ("+strconv.Itoa(newmirror.ID)+","+strconv.Itoa(repo.ID)+",0,1)")
       if txerr != nil { log.Println("Failed to INSERT into status table") }
     }
   }
@@ -822,52 +1575,285 @@ func http_handler_mirror_post (ctx *fasthttp.RequestCtx) {
 
   // Report success
   log.Printf("Added mirror %s (ID %d)\n", newmirror.Name, newmirror.ID);
-  ctx.SetStatusCode(http.StatusCreated)
+  respond_after_checks(ctx, http.StatusCreated, `mirror_id`, newmirror.ID)
+}
+
+// Flags the status rows of a mirror for an immediate check by the updater
+func http_handler_mirror_recheck (ctx *fasthttp.RequestCtx) {
+  mirror_id, exists := mirror_name_to_id(ctx.UserValue("name").(string))
+  if !exists {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  recheck(ctx, `mirror_id`, mirror_id)
+}
+
+// Flags the status rows of a repo for an immediate check by the updater
+func http_handler_repo_recheck (ctx *fasthttp.RequestCtx) {
+  repo_id, converr := strconv.Atoi(ctx.UserValue("id").(string))
+  if converr != nil {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    return
+  }
+
+  recheck(ctx, `repo_id`, repo_id)
+}
+
+// Creates a new token for /report, only its hash is stored
+func http_handler_mirror_token (ctx *fasthttp.RequestCtx) {
+  mirror_id, exists := mirror_name_to_id(ctx.UserValue("name").(string))
+  if !exists {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  random := make([]byte, 32)
+  _, err := rand.Read(random)
+  if err == nil {
+    token := hex.EncodeToString(random)
+    _, err = mirrordb.Exec(`UPDATE mirrors SET token = ? WHERE mirror_id = ?`, hash_token(token), mirror_id)
+    if err == nil {
+      log.Printf("Created report token for mirror %s (ID %d)\n", ctx.UserValue("name"), mirror_id)
+      ctx.SetStatusCode(http.StatusCreated)
+      ctx.Response.Header.Set("Content-Type", "application/json")
+      _, werr := ctx.Write([]byte(`{"token":"`+token+`"}`))
+      if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+      return
+    }
+  }
+
+  ctx.SetStatusCode(http.StatusInternalServerError)
+  _, werr := ctx.Write([]byte(err.Error()))
+  if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+}
+
+// A mirror reports a finished sync (POST /report?mirror=<name> with `Authorization: Bearer <token>`)
+// This only schedules a check, the updater verifies the repositories itself
+func http_handler_report (ctx *fasthttp.RequestCtx) {
+  set_headers(ctx)
+
+  name := string(ctx.FormValue("mirror"))
+  token := strings.TrimPrefix(string(ctx.Request.Header.Peek("Authorization")), "Bearer ")
+  if name == `` || token == `` {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    _, werr := ctx.Write([]byte("mirror and token required\n"))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  var mirror_id int
+  var stored string
+  var reported int64
+  row := mirrordb.QueryRow(`SELECT mirror_id, token, reported FROM mirrors WHERE name = ?`, name)
+  err := row.Scan(&mirror_id, &stored, &reported)
+
+  // Unknown mirrors and mirrors without token are not distinguished from a wrong token
+  if err != nil || stored == `` || subtle.ConstantTimeCompare([]byte(stored), []byte(hash_token(token))) != 1 {
+    log.Printf("Rejected sync report for mirror %s from %s\n", name, ctx.RemoteIP())
+    ctx.SetStatusCode(http.StatusUnauthorized)
+    return
+  }
+
+  now := time.Now().Unix()
+  if now - reported < reportinterval {
+    ctx.SetStatusCode(http.StatusTooManyRequests)
+    return
+  }
+
+  _, err = mirrordb.Exec(`UPDATE mirrors SET reported = ? WHERE mirror_id = ?`, now, mirror_id)
+  if err == nil {
+    _, err = mirrordb.Exec(`UPDATE status SET priority = 1 WHERE mirror_id = ?`, mirror_id)
+  }
+  if err != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(err.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  log.Printf("Mirror %s reported a finished sync\n", name)
+  ctx.SetStatusCode(http.StatusAccepted)
+}
+
+func hash_token (token string) (string) {
+  hash := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(hash[:])
+}
+
+// Marks a new version of the repo as published (?timestamp= is its repomd.xml timestamp)
+// Mirrors are treated as behind until their check confirms the timestamp
+func http_handler_repo_publish (ctx *fasthttp.RequestCtx) {
+  repo_id, converr := strconv.Atoi(ctx.UserValue("id").(string))
+  timestamp, tserr := strconv.ParseInt(string(ctx.QueryArgs().Peek("timestamp")), 10, 64)
+  if converr != nil || tserr != nil || timestamp <= 0 {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    _, werr := ctx.Write([]byte("Required parameter: timestamp"))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  exists, err := lib.PublishRepo(mirrordb, repo_id, timestamp)
+  if err != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(err.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+  if !exists {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  // Cached lists do not know that their mirrors are behind now
+  if caching { rescache.Clear() }
+
+  log.Printf("Published repo ID %d with timestamp %d\n", repo_id, timestamp)
+  respond_after_checks(ctx, http.StatusOK, `repo_id`, repo_id)
+}
+
+func recheck (ctx *fasthttp.RequestCtx, column string, id int) {
+  result, err := mirrordb.Exec("UPDATE status SET priority = 1 WHERE "+column+" = ?", id)
+  if err != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(err.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  if flagged, _ := result.RowsAffected(); flagged == 0 {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  log.Printf("Flagged %s %d for recheck\n", column, id)
+  respond_after_checks(ctx, http.StatusOK, column, id)
 }
 
-func get_repo_id (release string, repo string, arch string) (int, string, bool) {
+// With ?wait=<seconds>, waits until the updater has checked all status rows of the mirror or repo
+// Responds with the given code and the check results, or with 202 Accepted if they are not available in time
+func respond_after_checks (ctx *fasthttp.RequestCtx, status int, column string, id int) {
+  if len(ctx.QueryArgs().Peek("wait")) == 0 {
+    if status == http.StatusOK { status = http.StatusAccepted }
+    ctx.SetStatusCode(status)
+    return
+  }
+
+  wait, converr := strconv.Atoi(string(ctx.QueryArgs().Peek("wait")))
+  if converr != nil || wait < 0 {
+    ctx.SetStatusCode(http.StatusBadRequest)
+    return
+  }
+  if wait > 300 { wait = 300 }
+
+  since := time.Now().Unix()
+  deadline := time.Now().Add(time.Duration(wait) * time.Second)
+  checks := []lib.CheckStatus{}
+  for {
+    checks = []lib.CheckStatus{}
+    // Disabled repos and releases past their end of life are not checked by the updater
+    err := mirrordb.Select(&checks, "SELECT status.mirror_id, status.repo_id, status.timestamp, status.checked, status.result FROM status "+
+                                    "JOIN repos ON repos.repo_id = status.repo_id "+
+                                    "LEFT JOIN releases ON releases.major_release = repos.major_release "+
+                                    "WHERE status."+column+" = ? AND repos.enabled > 0 AND (releases.eol IS NULL OR releases.eol = 0 OR releases.eol > ?)",
+                           id, time.Now().Unix())
+    if err != nil { log.Println(err) }
+
+    done := err == nil
+    for _, check := range checks {
+      if check.Checked < since { done = false }
+    }
+
+    if done { break }
+    if time.Now().After(deadline) {
+      status = http.StatusAccepted
+      break
+    }
+    time.Sleep(500 * time.Millisecond)
+  }
+
+  result, jsonerr := json.Marshal(checks)
+  if jsonerr != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(jsonerr.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  ctx.SetStatusCode(status)
+  ctx.Response.Header.Set("Content-Type", "application/json")
+  _, werr := ctx.Write(result)
+  if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+}
+
+// Also returns the published timestamp, which is part of the cache key
+func get_repo_id (release string, repo string, arch string, enabled_only bool) (int, string, bool, int64) {
   var repoid int = -1
   var repopath string
   var is_altarch bool
+  var published int64
 
-  stmt1, _ := mirrordb.Prepare(`SELECT repo_id, path, is_altarch FROM repos WHERE enabled > 0 AND major_release = ? AND name = ? AND arch = ?`)
+  // Repos of releases past their end of life are usually disabled, but still in the vault
+  query := `SELECT repo_id, path, is_altarch, published FROM repos WHERE major_release = ? AND name = ? AND arch = ?`
+  if enabled_only { query += ` AND enabled > 0` }
 
-  row := stmt1.QueryRow(release, repo, arch)
-  err := row.Scan(&repoid, &repopath, &is_altarch)
+  row := mirrordb.QueryRow(query, release, repo, arch)
+  err := row.Scan(&repoid, &repopath, &is_altarch, &published)
 
-  if err != nil { return -1, ``, false }
-  return repoid, repopath, is_altarch
+  if err != nil { return -1, ``, false, 0 }
+  return repoid, repopath, is_altarch, published
 }
 
-func mirrors_with_repo (repoid int) ([]int) {
+// Returns the mirrors which have the latest published version of the repo and those which are behind
+// All mirrors are current if the repo was never published
+// Mirrors whose last check failed count as behind. The result from the client's vantage is used if it is recent,
+// so that mirrors unreachable from the client's region are avoided
+func mirrors_with_repo (repoid int, protocol string, vantage string) ([]int, []int) {
   var mirrorid int
-  var result []int
+  var behind int
+  var current []int
+  var behindlist []int
 
   var random string = lib.DB_Random(dbtype)
-  stmt1, err1 := mirrordb.Prepare("SELECT status.mirror_id FROM status "+
+  stmt1, err1 := mirrordb.Prepare("SELECT status.mirror_id, CASE WHEN status.timestamp < repos.published THEN 1 "+
+                                  "WHEN vantage_status.checked > ? AND vantage_status.result != 200 THEN 1 "+
+                                  "WHEN (vantage_status.checked IS NULL OR vantage_status.checked <= ?) AND status.checked > 0 AND status.result != 200 THEN 1 "+
+                                  "WHEN ? > 0 AND mirrors.ttfb > ? THEN 1 "+
+                                  "WHEN status.integrity != 0 AND status.integrity != 200 THEN 1 "+
+                                  "ELSE 0 END FROM status "+
                                   "JOIN mirrors ON status.mirror_id = mirrors.mirror_id "+
-				  "WHERE status.repo_id = ? AND mirrors.enabled > 0 ORDER BY status.timestamp DESC, "+random)
+                                  "JOIN repos ON status.repo_id = repos.repo_id "+
+                                  "LEFT JOIN vantage_status ON vantage_status.mirror_id = status.mirror_id AND vantage_status.repo_id = status.repo_id "+
+                                  "AND vantage_status.vantage = ? "+
+				  "WHERE status.repo_id = ? AND mirrors.enabled > 0 AND mirrors.auto_disabled = 0 AND mirrors."+protocol+" > 0 "+
+				  "ORDER BY status.timestamp DESC, "+random)
   if err1 != nil {
     log.Println(err1)
-    return result
+    return current, behindlist
   }
+  defer stmt1.Close()
 
-  rows, err := stmt1.Query(repoid)
+  recent := time.Now().Unix() - vantagemaxage
+  rows, err := stmt1.Query(recent, recent, slowttfb, slowttfb, vantage, repoid)
   if err != nil {
     log.Println(err)
-    return result
+    return current, behindlist
   }
   defer rows.Close()
 
   for rows.Next() {
-    _ = rows.Scan(&mirrorid)
-    result = append(result, mirrorid)
+    _ = rows.Scan(&mirrorid, &behind)
+    if behind > 0 {
+      behindlist = append(behindlist, mirrorid)
+    } else {
+      current = append(current, mirrorid)
+    }
   }
 
-  return result
+  return current, behindlist
 }
 
-func full_mirror_urls (mirrors []int, release string, repo string, arch string, is_altarch bool) ([]byte) {
+func full_mirror_urls (mirrors []int, protocol string, release string, repo string, arch string, is_altarch bool) ([]byte) {
   var result string
 
   q, args, err := sqlx.In(`SELECT name, basedir, basedir_altarch FROM mirrors WHERE mirror_id IN (?)`, mirrors)
@@ -883,8 +1869,7 @@ func full_mirror_urls (mirrors []int, release string, repo string, arch string,
   }
   defer rows.Close()
 
-  seven := regexp.MustCompile(`^7`)
-  eight := regexp.MustCompile(`^8`)
+  subdir := repo_subdir(release, repo, arch)
 
   for rows.Next() {
     var name string
@@ -896,17 +1881,91 @@ func full_mirror_urls (mirrors []int, release string, repo string, arch string,
     directory = basedir
     if is_altarch { directory = basedir_alt }
 
-    if seven.MatchString(release) { result += "http://"+name+"/"+directory+"/"+release+"/"+repo+"/"+arch+"/"+"\n" }
-    if eight.MatchString(release) { result += "http://"+name+"/"+directory+"/"+release+"/"+repo+"/"+arch+"/os/"+"\n" }
+    if subdir != `` { result += protocol+"://"+name+"/"+directory+"/"+subdir+"\n" }
+  }
+
+  // fasthttp and freecache both prefer byte slices
+  return []byte(remove_multislash(result))
+}
+
+func format_response (urls []byte, format string) ([]byte) {
+  if format != `json` { return urls }
+
+  // JSON responses are an array of URLs
+  list := []string{}
+  for _, line := range strings.Split(string(urls), "\n") {
+    if line != `` { list = append(list, line) }
+  }
+
+  result, err := json.Marshal(list)
+  if err != nil {
+    log.Printf("format_response -> json -> %s\n", err)
+    return []byte(``)
+  }
+
+  return result
+}
+
+func vault_urls (vault string, release string, repo string, arch string) ([]byte) {
+  var result string
+
+  // The vault may consist of multiple base URLs, separated by whitespace
+  subdir := repo_subdir(release, repo, arch)
+  for _, base := range strings.Fields(vault) {
+    if subdir != `` { result += base+"/"+subdir+"\n" }
   }
 
+  return []byte(remove_multislash(result))
+}
+
+func repo_subdir (release string, repo string, arch string) (string) {
+  seven := regexp.MustCompile(`^7`)
+  eight := regexp.MustCompile(`^8`)
+
+  // 8.x has an additional /os subfolder which does not exist for 7.x
+  if seven.MatchString(release) { return release+"/"+repo+"/"+arch+"/" }
+  if eight.MatchString(release) { return release+"/"+repo+"/"+arch+"/os/" }
+
+  return ``
+}
+
+func remove_multislash (input string) (string) {
   // Duplicate slashes are possible, let's get rid of those
   // Match \w before // (does not include `:`)
   multislash := regexp.MustCompile(`(\w)\/+`)
-  result = multislash.ReplaceAllString(result, "$1/")
+  return multislash.ReplaceAllString(input, "$1/")
+}
 
-  // fasthttp and freecache both prefer byte slices
-  return []byte(result)
+func normalise_arch (arch string) (string) {
+  var basearch string
+
+  row := mirrordb.QueryRow(`SELECT arch FROM arches WHERE alias = ?`, arch)
+  err := row.Scan(&basearch)
+
+  // Anything without an alias is used as-is
+  if err != nil || basearch == `` { return arch }
+  return basearch
+}
+
+// Aliases may map to themselves (e.g. armhfp), so normalise_arch cannot tell whether one exists
+func arch_alias_exists (alias string) (bool, error) {
+  var found int
+  err := mirrordb.QueryRow(`SELECT 1 FROM arches WHERE alias = ?`, alias).Scan(&found)
+  if err == sql.ErrNoRows { return false, nil }
+  return err == nil, err
+}
+
+func get_release_eol (release string) (bool, string, string) {
+  var eol int64
+  var vault string
+  var vault_alt string
+
+  row := mirrordb.QueryRow(`SELECT eol, vault, vault_altarch FROM releases WHERE major_release = ?`, release)
+  err := row.Scan(&eol, &vault, &vault_alt)
+
+  // Releases without an entry have no end of life
+  if err != nil { return false, ``, `` }
+  return eol > 0 && eol <= time.Now().Unix(), vault, vault_alt
 }
 
 func check_geodb_age () {
@@ -923,7 +1982,7 @@ func http_handler_issues (ctx *fasthttp.RequestCtx) {
 
   rows, err := mirrordb.Query(`SELECT DISTINCT status.mirror_id, mirrors.name FROM status
                                JOIN mirrors ON status.mirror_id = mirrors.mirror_id
-			       WHERE result != 200 and checked > 0`)
+			       WHERE ((result != 200 OR inconsistent > 0) and checked > 0) OR (integrity != 0 AND integrity != 200)`)
   if err != nil {
     log.Println(err)
   }
@@ -956,14 +2015,70 @@ func http_handler_issues (ctx *fasthttp.RequestCtx) {
           issue.Errors["Unknown connection error"] = count
 	case -4:
           issue.Errors["Failed to parse repomd.xml"] = count
+	case -5:
+          issue.Errors["Redirect refused"] = count
+	case -6:
+          issue.Errors["ISO checksums differ from reference"] = count
         default:
           issue.Errors[fasthttp.StatusMessage(result)] = count
       }
     }
 
+    // repomd.xml differs from the reference with the same timestamp (e.g. broken sync)
+    var inconsistent int
+    row := mirrordb.QueryRow("SELECT count(*) FROM status WHERE mirror_id = "+strconv.Itoa(mirror_id)+" AND inconsistent > 0")
+    _ = row.Scan(&inconsistent)
+    if inconsistent > 0 {
+      issue.Errors["Inconsistent repomd.xml"] = inconsistent
+    }
+
+    // Packages missing or differing from the package list, found by the deep check
+    var corrupt int
+    row = mirrordb.QueryRow("SELECT count(*) FROM status WHERE mirror_id = "+strconv.Itoa(mirror_id)+" AND integrity != 0 AND integrity != 200")
+    _ = row.Scan(&corrupt)
+    if corrupt > 0 {
+      issue.Errors["Missing or corrupt packages"] = corrupt
+    }
+
     issues = append(issues, issue)
   }
 
+  // Certificates which are about to expire or failed to validate
+  var expiry int64
+  var tlserror string
+  rows3, err3 := mirrordb.Query(`SELECT name, cert_expiry, tls_error FROM mirrors
+                                 WHERE tls_checked > 0 AND ((cert_expiry > 0 AND cert_expiry < ?) OR tls_error != '')`,
+                                time.Now().Unix() + int64(certdays) * 86400)
+  if err3 != nil {
+    log.Println(err3)
+  }
+  defer rows3.Close()
+
+  for rows3.Next() {
+    _ = rows3.Scan(&name, &expiry, &tlserror)
+
+    index := issue_index(&issues, name)
+    if tlserror != `` {
+      issues[index].Errors["Invalid TLS certificate"] = 1
+    } else {
+      // Number of days left, negative if expired already
+      issues[index].Errors["Certificate expiring (days)"] = int((expiry - time.Now().Unix()) / 86400)
+    }
+  }
+
+  // Mirrors auto-disabled by mirrorlist_updater
+  var failures int
+  rows4, err4 := mirrordb.Query(`SELECT name, failures FROM mirrors WHERE auto_disabled > 0`)
+  if err4 != nil {
+    log.Println(err4)
+  }
+  defer rows4.Close()
+
+  for rows4.Next() {
+    _ = rows4.Scan(&name, &failures)
+    issues[issue_index(&issues, name)].Errors["Auto-disabled (consecutive failures)"] = failures
+  }
+
   // Return 204 No Content if no issues are found
   if len(issues) == 0 {
     ctx.SetStatusCode(http.StatusNoContent)
@@ -983,6 +2098,16 @@ func http_handler_issues (ctx *fasthttp.RequestCtx) {
   if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
 }
 
+// Returns the position of a mirror's issue in the list, a new issue is added if there is none
+func issue_index (issues *[]lib.Issue, name string) (int) {
+  for i := range *issues {
+    if (*issues)[i].Name == name { return i }
+  }
+
+  *issues = append(*issues, lib.Issue{Name: name, Errors: make(map[string]int)})
+  return len(*issues) - 1
+}
+
 func convert_interface (iface interface{}) (string) {
   switch v := iface.(type) {
     case bool:
@@ -1008,6 +2133,18 @@ func repolist () ([]lib.Repo, error) {
   return all, err
 }
 
+func releaselist () ([]lib.Release, error) {
+  all := []lib.Release{}
+  err := mirrordb.Select(&all, `SELECT * FROM releases`)
+  return all, err
+}
+
+func archlist () ([]lib.Arch, error) {
+  all := []lib.Arch{}
+  err := mirrordb.Select(&all, `SELECT * FROM arches`)
+  return all, err
+}
+
 func mirrorlist () ([]lib.Mirror, error) {
   all := []lib.Mirror{}
   err := mirrordb.Select(&all, `SELECT * FROM mirrors`)
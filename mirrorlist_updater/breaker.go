@@ -0,0 +1,68 @@
+package main
+
+import "log"
+import "net/http"
+import "time"
+
+import "github.com/jmoiron/sqlx"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Circuit breaker settings, read from `backend.breaker`
+// Mirrors are auto-disabled after a number of consecutive failed checks and re-enabled
+// after a number of consecutive successful checks. This is separate from the `enabled` column.
+type Breaker struct {
+  Failures    int
+  Successes   int
+  Backoff     int64	// Seconds until the first re-check of an auto-disabled mirror
+  MaxBackoff  int64	// Upper limit, the backoff doubles after each failed re-check
+}
+
+var breaker Breaker
+
+// Runs within the transaction writing the check result
+func update_mirror_health (tx *sqlx.Tx, cr lib.CheckResult) (error) {
+  var err error
+
+  if cr.Result == http.StatusOK {
+    _, err = tx.Exec(`UPDATE mirrors SET successes = successes + 1, failures = 0 WHERE mirror_id = ?`, cr.MirrorID)
+  } else {
+    _, err = tx.Exec(`UPDATE mirrors SET failures = failures + 1, successes = 0 WHERE mirror_id = ?`, cr.MirrorID)
+  }
+  if err != nil { return err }
+
+  var name string
+  var disabled bool
+  var failures int
+  var successes int
+  var backoff int64
+  var backoffuntil int64
+  row := tx.QueryRow(`SELECT name, auto_disabled, failures, successes, backoff, backoff_until FROM mirrors WHERE mirror_id = ?`, cr.MirrorID)
+  err = row.Scan(&name, &disabled, &failures, &successes, &backoff, &backoffuntil)
+  if err != nil { return err }
+
+  switch {
+    // Too many failures, take the mirror out of the selection
+    case !disabled && failures >= breaker.Failures:
+      log.Printf("Auto-disabling mirror %s after %d failed checks\n", name, failures)
+      _, err = tx.Exec(`UPDATE mirrors SET auto_disabled = 1, backoff = ?, backoff_until = ? WHERE mirror_id = ?`,
+                             breaker.Backoff, time.Now().Unix() + breaker.Backoff, cr.MirrorID)
+
+    // Still failing, wait longer until the next check
+    // Only once per round, other results of the same round find the new backoff running already
+    case disabled && cr.Result != http.StatusOK && backoffuntil <= time.Now().Unix():
+      backoff *= 2
+      if backoff > breaker.MaxBackoff { backoff = breaker.MaxBackoff }
+      if backoff < breaker.Backoff { backoff = breaker.Backoff }
+      _, err = tx.Exec(`UPDATE mirrors SET backoff = ?, backoff_until = ? WHERE mirror_id = ?`,
+                             backoff, time.Now().Unix() + backoff, cr.MirrorID)
+
+    // Working again
+    case disabled && successes >= breaker.Successes:
+      log.Printf("Re-enabling mirror %s after %d successful checks\n", name, successes)
+      _, err = tx.Exec(`UPDATE mirrors SET auto_disabled = 0, backoff = 0, backoff_until = 0 WHERE mirror_id = ?`, cr.MirrorID)
+  }
+  if err != nil { return err }
+
+  return nil
+}
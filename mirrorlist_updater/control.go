@@ -0,0 +1,112 @@
+package main
+
+import "encoding/json"
+import "log"
+import "net/http"
+import "strconv"
+
+import "github.com/valyala/fasthttp"
+import "github.com/fasthttp/router"
+
+// Local HTTP interface to inspect and steer the updater, enabled by `backend.control.listen`
+// It has no authentication, so it should only listen on localhost
+type ControlStatus struct {
+  Paused      bool   `json:"paused"`
+  Queued      int    `json:"queued"`
+  InFlight    int    `json:"inflight"`
+}
+
+func control_server (listen string) {
+  routes := router.New()
+
+  routes.GET("/status", control_handler_status)
+  routes.GET("/queue", control_handler_queue)
+  routes.GET("/inflight", control_handler_inflight)
+  routes.POST("/recheck/mirrors/{name}", control_handler_recheck)
+  routes.POST("/recheck/repos/{id}", control_handler_recheck)
+  routes.POST("/recheck/mirrors/{name}/repos/{id}", control_handler_recheck)
+  routes.POST("/pause", control_handler_pause)
+  routes.POST("/resume", control_handler_resume)
+
+  log.Printf("Starting control interface on %s\n", listen)
+  laserr := fasthttp.ListenAndServe(listen, routes.Handler)
+  if laserr != nil {
+    log.Fatal(laserr)
+  }
+}
+
+func control_handler_status (ctx *fasthttp.RequestCtx) {
+  control_json(ctx, http.StatusOK, ControlStatus{ Paused: scheduler.Paused(),
+                                                  Queued: scheduler.Pending(),
+                                                  InFlight: len(scheduler.InFlight()) })
+}
+
+func control_handler_queue (ctx *fasthttp.RequestCtx) {
+  control_json(ctx, http.StatusOK, scheduler.Queued())
+}
+
+func control_handler_inflight (ctx *fasthttp.RequestCtx) {
+  control_json(ctx, http.StatusOK, scheduler.InFlight())
+}
+
+// Queues checks of a mirror, a repo or both in front of all others, regardless of when they were checked last
+func control_handler_recheck (ctx *fasthttp.RequestCtx) {
+  condition := `1 = 1`
+  var args []interface{}
+
+  if name, ok := ctx.UserValue("name").(string); ok {
+    condition += ` AND mirrors.name = ?`
+    args = append(args, name)
+  }
+  if id, ok := ctx.UserValue("id").(string); ok {
+    repo_id, converr := strconv.Atoi(id)
+    if converr != nil {
+      ctx.SetStatusCode(http.StatusBadRequest)
+      return
+    }
+    condition += ` AND status.repo_id = ?`
+    args = append(args, repo_id)
+  }
+
+  tasks := check_tasks(condition, args...)
+  if len(tasks) == 0 {
+    ctx.SetStatusCode(http.StatusNotFound)
+    return
+  }
+
+  // Added in reverse, so that they run in the order found
+  var queued int
+  for i := len(tasks) - 1; i >= 0; i-- {
+    if scheduler.AddFirst(tasks[i]) { queued++ }
+  }
+  log.Printf("Queued %d rechecks (%s)\n", queued, ctx.Path())
+
+  control_json(ctx, http.StatusAccepted, map[string]int{ "queued": queued })
+}
+
+func control_handler_pause (ctx *fasthttp.RequestCtx) {
+  scheduler.Pause(true)
+  log.Println("Scheduling paused")
+  ctx.SetStatusCode(http.StatusNoContent)
+}
+
+func control_handler_resume (ctx *fasthttp.RequestCtx) {
+  scheduler.Pause(false)
+  log.Println("Scheduling resumed")
+  ctx.SetStatusCode(http.StatusNoContent)
+}
+
+func control_json (ctx *fasthttp.RequestCtx, status int, data interface{}) {
+  result, err := json.Marshal(data)
+  if err != nil {
+    ctx.SetStatusCode(http.StatusInternalServerError)
+    _, werr := ctx.Write([]byte(err.Error()))
+    if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+    return
+  }
+
+  ctx.SetStatusCode(status)
+  ctx.Response.Header.Set("Content-Type", "application/json")
+  _, werr := ctx.Write(result)
+  if werr != nil { log.Printf("ctx.Write failed: %s\n", werr.Error()) }
+}
@@ -0,0 +1,261 @@
+package main
+
+import "bufio"
+import "log"
+import "net/http"
+import "net/url"
+import "regexp"
+import "strconv"
+import "strings"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Settings for repository discovery, read from `backend.discovery`
+type Discovery struct {
+  Master         string		// Base URL of the master mirror (e.g. http://mirror.centos.org/centos/)
+  MasterAlt      string		// Base URL of the altarch tree on the master mirror, optional
+  Filelist       string		// File list relative to the master, used instead of crawling if set
+  Exclude        *regexp.Regexp	// Relative paths to skip (e.g. symlinks like `7/` to `7.9.2009/`)
+  Depth          int
+  Interval       int
+  Create         bool		// Create repos and status rows, otherwise only log them
+}
+
+func discovery_loop (d Discovery) {
+  job_loop(`discovery`, time.Duration(d.Interval) * time.Second, func () {
+    log.Printf("Starting repository discovery on %s\n", d.Master)
+    found := discover_repos(d.Master, false, d)
+    if d.MasterAlt != `` {
+      found = append(found, discover_repos(d.MasterAlt, true, d)...)
+    }
+    log.Printf("Discovery found %d repositories\n", len(found))
+
+    for _, repo := range found {
+      if repo_exists(repo) { continue }
+
+      if !d.Create {
+        log.Printf("Discovered new repo: release %d, path %s, name %s, arch %s, altarch %t\n",
+                   repo.MRelease, repo.Path, repo.Name, repo.Arch, repo.Altarch)
+        continue
+      }
+
+      repoid, err := create_repo(repo)
+      if err != nil {
+        log.Printf("Failed to create discovered repo %s/%s/%s: %s\n", repo.Path, repo.Name, repo.Arch, err)
+        continue
+      }
+      log.Printf("Created discovered repo ID %d (%s/%s/%s)\n", repoid, repo.Path, repo.Name, repo.Arch)
+    }
+  })
+}
+
+func discover_repos (base string, altarch bool, d Discovery) ([]lib.Repo) {
+  var dirs []string
+
+  if !strings.HasSuffix(base, "/") { base += "/" }
+
+  if d.Filelist != `` {
+    dirs = filelist_dirs(base, d.Filelist)
+  } else {
+    dirs = crawl_dirs(base, ``, d.Depth, d.Exclude)
+  }
+
+  var result []lib.Repo
+  for _, dir := range dirs {
+    if d.Exclude != nil && d.Exclude.MatchString(dir) { continue }
+
+    repo, valid := dir_to_repo(dir, altarch)
+    if valid { result = append(result, repo) }
+  }
+
+  return result
+}
+
+// Walks HTTP index pages and returns the relative directories holding a repository or ISO checksums
+func crawl_dirs (base string, dir string, depth int, exclude *regexp.Regexp) ([]string) {
+  var result []string
+
+  if depth < 0 { return result }
+  if exclude != nil && dir != `` && exclude.MatchString(dir) { return result }
+
+  links := index_links(base + dir)
+
+  for _, link := range links {
+    // A repository, checked by reading its repomd.xml
+    if link == `repodata/` {
+      _, httpcode, _ := repository_timestamp(strings.TrimSuffix(base + dir, "/"), nil, nil)
+      if httpcode == http.StatusOK { result = append(result, dir) }
+      return result
+    }
+
+    // ISO directories have a checksum file instead
+    if link == `CHECKSUM` || link == `sha256sum.txt` {
+      result = append(result, dir)
+      return result
+    }
+  }
+
+  for _, link := range links {
+    if strings.HasSuffix(link, "/") {
+      result = append(result, crawl_dirs(base, dir + link, depth - 1, exclude)...)
+    }
+  }
+
+  return result
+}
+
+// Returns the relative links of an index page, directories end in /
+func index_links (pageurl string) ([]string) {
+  var result []string
+  hrefregex := regexp.MustCompile(`href="([^"?#]+)"`)
+
+  resp, err := probe_get(pageurl)
+  if err != nil {
+    log.Printf("Failed to read index %s: %s\n", pageurl, err)
+    return result
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK { return result }
+
+  scanner := bufio.NewScanner(resp.Body)
+  for scanner.Scan() {
+    for _, match := range hrefregex.FindAllStringSubmatch(scanner.Text(), -1) {
+      link, uerr := url.PathUnescape(match[1])
+      if uerr != nil { continue }
+
+      // Skip parent directory, absolute links and other sites
+      if strings.HasPrefix(link, "/") || strings.HasPrefix(link, ".") || strings.Contains(link, ":") { continue }
+      result = append(result, link)
+    }
+  }
+
+  return result
+}
+
+// Reads a published file list (one path per line, the last field is used) and returns repository directories
+func filelist_dirs (base string, filelist string) ([]string) {
+  var result []string
+
+  // File lists are large, so they get more time than other requests
+  client := long_http_client(300 * time.Second)
+  req, err := http.NewRequest("GET", base + filelist, nil)
+  if err != nil {
+    log.Print(err)
+    return result
+  }
+  req.Header.Set("User-Agent", useragent)
+  resp, err := probe_do(client, req)
+  if err != nil {
+    log.Printf("Failed to read file list %s: %s\n", base + filelist, err)
+    return result
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK {
+    log.Printf("Failed to read file list %s [%d]\n", base + filelist, resp.StatusCode)
+    return result
+  }
+
+  seen := make(map[string]bool)
+  scanner := bufio.NewScanner(resp.Body)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 0 { continue }
+    path := strings.TrimPrefix(fields[len(fields)-1], "./")
+
+    var dir string
+    switch {
+      case strings.HasSuffix(path, "/repodata/repomd.xml"):
+        dir = strings.TrimSuffix(path, "repodata/repomd.xml")
+      case strings.HasSuffix(path, "/CHECKSUM"):
+        dir = strings.TrimSuffix(path, "CHECKSUM")
+      case strings.HasSuffix(path, "/sha256sum.txt"):
+        dir = strings.TrimSuffix(path, "sha256sum.txt")
+      default:
+        continue
+    }
+
+    if !seen[dir] {
+      seen[dir] = true
+      result = append(result, dir)
+    }
+  }
+
+  return result
+}
+
+// Maps a relative directory (e.g. 8/BaseOS/x86_64/os/) to a repo
+// This is the reverse of the URL built in find_next_check
+func dir_to_repo (dir string, altarch bool) (lib.Repo, bool) {
+  var repo lib.Repo
+  releaseregex := regexp.MustCompile(`^(\d+)`)
+
+  parts := strings.Split(strings.Trim(dir, "/"), "/")
+
+  // 8.x has an additional /os subfolder which does not exist for 7.x
+  if len(parts) == 4 && parts[3] == `os` { parts = parts[:3] }
+  if len(parts) != 3 { return repo, false }
+
+  release := releaseregex.FindStringSubmatch(parts[0])
+  if len(release) != 2 { return repo, false }
+  repo.MRelease, _ = strconv.Atoi(release[1])
+
+  repo.Path = parts[0]
+  repo.Name = parts[1]
+  repo.Arch = parts[2]
+  repo.Altarch = altarch
+  repo.Enabled = true
+
+  return repo, true
+}
+
+func repo_exists (repo lib.Repo) (bool) {
+  var count int
+  row := mirrordb.QueryRow(`SELECT COUNT(*) FROM repos WHERE major_release = ? AND path = ? AND name = ? AND arch = ? AND is_altarch = ?`,
+                           repo.MRelease, repo.Path, repo.Name, repo.Arch, lib.Bool_to_int(repo.Altarch))
+  err := row.Scan(&count)
+  if err != nil {
+    log.Println(err)
+    // Pretend it exists, so we don't create duplicates
+    return true
+  }
+
+  return count > 0
+}
+
+// Creates the repo and adds it to all applicable mirrors, like POST /admin/repos does
+func create_repo (repo lib.Repo) (int, error) {
+  var repoid int
+
+  tx, err := mirrordb.Begin()
+  if err != nil { return -1, err }
+
+  _, err = tx.Exec(`INSERT INTO repos (major_release, name, path, arch, is_altarch, enabled) VALUES (?, ?, ?, ?, ?, ?)`,
+                   repo.MRelease, repo.Name, repo.Path, repo.Arch, lib.Bool_to_int(repo.Altarch), lib.Bool_to_int(repo.Enabled))
+  if err != nil {
+    _ = tx.Rollback()
+    return -1, err
+  }
+
+  // We could use LastInsertId here, but that is not supported by all database drivers
+  row := tx.QueryRow(`SELECT MAX(repo_id) FROM repos WHERE major_release = ? AND path = ? AND name = ? AND arch = ? AND is_altarch = ?`,
+                     repo.MRelease, repo.Path, repo.Name, repo.Arch, lib.Bool_to_int(repo.Altarch))
+  err = row.Scan(&repoid)
+  if err != nil {
+    _ = tx.Rollback()
+    return -1, err
+  }
+
+  // Mirrors with the matching base directory carry the new repo
+  basedir := `basedir`
+  if repo.Altarch { basedir = `basedir_altarch` }
+  _, err = tx.Exec("INSERT INTO status (mirror_id, repo_id, checked) SELECT mirror_id, ?, 0 FROM mirrors WHERE "+basedir+" != ''", repoid)
+  if err != nil {
+    _ = tx.Rollback()
+    return -1, err
+  }
+
+  return repoid, tx.Commit()
+}
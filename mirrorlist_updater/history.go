@@ -0,0 +1,148 @@
+package main
+
+import "database/sql"
+import "log"
+import "time"
+
+import "github.com/jmoiron/sqlx"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Settings for the check history, read from `backend.history`
+type History struct {
+  Retention        int64		// Seconds to keep history, 0 keeps it forever
+  DownsampleAfter  int64		// Age in seconds after which checks are merged, 0 disables downsampling
+  Bucket           int64		// Seconds covered by one merged entry
+}
+
+var history History
+
+func add_history (stmt *sqlx.Stmt, cr lib.CheckResult) (error) {
+  var success int
+  if cr.Result == 200 { success = 1 }
+
+  _, err := stmt.Exec(cr.MirrorID, cr.RepoID, cr.Checked, cr.Result, cr.Latency, success)
+  return err
+}
+
+func history_loop () {
+  job_loop(`history`, 1 * time.Hour, func () {
+    now := time.Now().Unix()
+
+    if history.Retention > 0 {
+      result, err := mirrordb.Exec(`DELETE FROM status_history WHERE checked < ?`, now - history.Retention)
+      if err != nil { log.Println(err) }
+      if err == nil {
+        if deleted, _ := result.RowsAffected(); deleted > 0 { log.Printf("Expired %d history entries\n", deleted) }
+      }
+    }
+
+    if history.DownsampleAfter > 0 && history.Bucket > 0 {
+      // Only complete buckets are merged
+      cutoff := now - history.DownsampleAfter
+      cutoff -= cutoff % history.Bucket
+
+      // Merged up to here already, stored with the job so that it survives restarts
+      var from int64
+      err := mirrordb.Get(&from, `SELECT progress FROM jobs WHERE name = 'history'`)
+      if err != nil {
+        log.Println(err)
+        return
+      }
+
+      // Without progress (first run), start at the oldest entry which has not been merged
+      if from == 0 {
+        var oldest sql.NullInt64
+        err = mirrordb.Get(&oldest, `SELECT MIN(checked) FROM status_history WHERE samples = 1`)
+        if err != nil {
+          log.Println(err)
+          return
+        }
+        from = cutoff
+        if oldest.Valid && oldest.Int64 < cutoff { from = oldest.Int64 - oldest.Int64 % history.Bucket }
+      }
+
+      // One day at a time, so that a long backlog is not read into memory at once
+      chunk := history.Bucket * (86400 / history.Bucket + 1)
+      for from < cutoff {
+        until := from + chunk
+        if until > cutoff { until = cutoff }
+
+        err = downsample_history(from, until)
+        if err == nil {
+          _, err = mirrordb.Exec(`UPDATE jobs SET progress = ? WHERE name = 'history'`, until)
+        }
+        if err != nil {
+          log.Println(err)
+          return
+        }
+        from = until
+      }
+    }
+  })
+}
+
+// Merges the checks of each mirror and repo between from and until into one entry per bucket
+func downsample_history (from int64, until int64) (error) {
+  type Bucket struct {
+    MirrorID    int
+    RepoID      int
+    Start       int64
+  }
+
+  var entries []struct {
+    MirrorID    int   `db:"mirror_id"`
+    lib.HistoryEntry
+  }
+
+  err := mirrordb.Select(&entries, `SELECT mirror_id, repo_id, checked, result, latency, samples, successes FROM status_history
+                                    WHERE checked >= ? AND checked < ? ORDER BY checked ASC`, from, until)
+  if err != nil { return err }
+
+  merged := make(map[Bucket]lib.HistoryEntry)
+  count := make(map[Bucket]int)
+  for _, entry := range entries {
+    bucket := Bucket{ MirrorID: entry.MirrorID, RepoID: entry.RepoID, Start: entry.Checked - entry.Checked % history.Bucket }
+    total := merged[bucket]
+    count[bucket]++
+
+    total.RepoID = entry.RepoID
+    total.Checked = bucket.Start
+    total.Latency += entry.Latency * int64(entry.Samples)
+    total.Samples += entry.Samples
+    total.Successes += entry.Successes
+
+    // A failure is more interesting than the success that may follow it
+    if entry.Result != 200 || total.Result == 0 || total.Result == 200 { total.Result = entry.Result }
+
+    merged[bucket] = total
+  }
+
+  tx, err := mirrordb.Begin()
+  if err != nil { return err }
+
+  var buckets int
+  for bucket, total := range merged {
+    // Nothing to merge
+    if count[bucket] < 2 { continue }
+    buckets++
+
+    _, err = tx.Exec(`DELETE FROM status_history WHERE mirror_id = ? AND repo_id = ? AND checked >= ? AND checked < ?`,
+                     bucket.MirrorID, bucket.RepoID, bucket.Start, bucket.Start + history.Bucket)
+    if err != nil {
+      _ = tx.Rollback()
+      return err
+    }
+
+    _, err = tx.Exec(`INSERT INTO status_history (mirror_id, repo_id, checked, result, latency, samples, successes) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+                     bucket.MirrorID, bucket.RepoID, total.Checked, total.Result, total.Latency / int64(total.Samples), total.Samples, total.Successes)
+    if err != nil {
+      _ = tx.Rollback()
+      return err
+    }
+  }
+
+  if buckets > 0 { log.Printf("Downsampled %d history entries into %d\n", len(entries), len(merged)) }
+
+  return tx.Commit()
+}
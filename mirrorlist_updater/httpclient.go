@@ -0,0 +1,132 @@
+package main
+
+import "crypto/tls"
+import "errors"
+import "math/rand"
+import "net"
+import "net/http"
+import "net/http/httptrace"
+import "regexp"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Settings of the HTTP client used for all probes, read from `backend.http`
+type HTTPSettings struct {
+  ConnectTimeout  time.Duration
+  ReadTimeout     time.Duration		// Until the response headers arrive, the whole request may take ConnectTimeout + ReadTimeout
+  Retries         int			// Additional attempts after connection errors and 5xx responses
+  RetryJitter     time.Duration		// Maximum random wait before a retry
+  MaxRedirects    int
+  CrossHost       bool			// Follow redirects to other hosts
+}
+
+var httpsettings HTTPSettings
+
+// Shared by all probes, so that connections to the same mirror are re-used
+var httpclient *http.Client
+
+var errredirect = errors.New("redirect refused")
+
+func new_http_client (s HTTPSettings) (*http.Client) {
+  // https://stackoverflow.com/a/13263993
+  // https://medium.com/@nate510/don-t-use-go-s-default-http-client-4804cb19f779
+  transport := &http.Transport{ Proxy: http.ProxyFromEnvironment,
+                                DialContext: (&net.Dialer{ Timeout: s.ConnectTimeout, KeepAlive: 30 * time.Second }).DialContext,
+                                TLSHandshakeTimeout: s.ConnectTimeout,
+                                ResponseHeaderTimeout: s.ReadTimeout,
+                                MaxIdleConns: 100,
+                                MaxIdleConnsPerHost: 2,
+                                IdleConnTimeout: 90 * time.Second }
+
+  return &http.Client{ Transport: transport,
+                       Timeout: s.ConnectTimeout + s.ReadTimeout,
+                       CheckRedirect: func (req *http.Request, via []*http.Request) (error) {
+                         if len(via) > s.MaxRedirects { return errredirect }
+                         if !s.CrossHost && req.URL.Host != via[0].URL.Host { return errredirect }
+                         return nil
+                       } }
+}
+
+// For large downloads (file lists, packages), which need more time than the probes
+// The connections and redirect policy are shared with the probe client
+func long_http_client (timeout time.Duration) (*http.Client) {
+  return &http.Client{ Transport: httpclient.Transport, Timeout: timeout, CheckRedirect: httpclient.CheckRedirect }
+}
+
+// GET request with the configured user-agent and retries
+func probe_get (url string) (*http.Response, error) {
+  req, err := http.NewRequest("GET", url, nil)
+  if err != nil { return nil, err }
+  req.Header.Set("User-Agent", useragent)
+
+  return probe_do(httpclient, req)
+}
+
+// Same as probe_get, but records how long each phase of the request took, unless timings is nil
+// Validators of a previous response make it a conditional request
+func probe_get_timed (url string, timings *lib.Timings, validators lib.Validators) (*http.Response, error) {
+  req, err := http.NewRequest("GET", url, nil)
+  if err != nil { return nil, err }
+  req.Header.Set("User-Agent", useragent)
+  if validators.ETag != `` { req.Header.Set("If-None-Match", validators.ETag) }
+  if validators.LastModified != `` { req.Header.Set("If-Modified-Since", validators.LastModified) }
+
+  if timings == nil { return probe_do(httpclient, req) }
+
+  var dnsstart, connectstart, tlsstart, wrote time.Time
+  trace := &httptrace.ClientTrace{
+    // Re-used connections have no DNS lookup, connect or TLS handshake
+    GotConn: func (info httptrace.GotConnInfo) {
+      if info.Reused {
+        timings.DNS = -1
+        timings.Connect = -1
+        timings.TLS = -1
+      }
+    },
+    DNSStart: func (httptrace.DNSStartInfo) { dnsstart = time.Now() },
+    DNSDone: func (httptrace.DNSDoneInfo) { timings.DNS = time.Since(dnsstart).Milliseconds() },
+    ConnectStart: func (string, string) { connectstart = time.Now() },
+    ConnectDone: func (string, string, error) { timings.Connect = time.Since(connectstart).Milliseconds() },
+    TLSHandshakeStart: func () { tlsstart = time.Now() },
+    TLSHandshakeDone: func (tls.ConnectionState, error) { timings.TLS = time.Since(tlsstart).Milliseconds() },
+    WroteRequest: func (httptrace.WroteRequestInfo) { wrote = time.Now() },
+    GotFirstResponseByte: func () { timings.TTFB = time.Since(wrote).Milliseconds() },
+  }
+
+  return probe_do(httpclient, req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+func probe_do (client *http.Client, req *http.Request) (*http.Response, error) {
+  var resp *http.Response
+  var err error
+
+  for attempt := 0; attempt <= httpsettings.Retries; attempt++ {
+    if attempt > 0 && httpsettings.RetryJitter > 0 {
+      time.Sleep(time.Duration(rand.Int63n(int64(httpsettings.RetryJitter))))
+    }
+
+    resp, err = client.Do(req)
+
+    // Only connection errors and server errors are worth another try
+    if err == nil && resp.StatusCode < 500 { return resp, nil }
+    if errors.Is(err, errredirect) || attempt == httpsettings.Retries { break }
+    if resp != nil { resp.Body.Close() }
+  }
+
+  return resp, err
+}
+
+// Maps errors of a probe to the result codes stored in the status table
+func probe_error_code (err error) (int) {
+  // https://stackoverflow.com/a/42718113
+  nosuchhost, _ := regexp.MatchString(`no such host`, err.Error())
+  if nosuchhost { return -1 }
+
+  var neterr net.Error
+  if errors.As(err, &neterr) && neterr.Timeout() { return -2 }
+
+  if errors.Is(err, errredirect) { return -5 }
+
+  return -3
+}
@@ -0,0 +1,246 @@
+package main
+
+import "compress/bzip2"
+import "compress/gzip"
+import "crypto/sha1"
+import "crypto/sha256"
+import "crypto/sha512"
+import "encoding/hex"
+import "encoding/xml"
+import "hash"
+import "io"
+import "io/ioutil"
+import "log"
+import "math/rand"
+import "net/http"
+import "strconv"
+import "strings"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Settings for the deep check, read from `backend.integrity`
+type Integrity struct {
+  Interval    int64		// Seconds between two deep checks of the same repo on a mirror
+  Samples     int		// Packages checked per repo, 0 disables the deep check
+  Verify      bool		// Download the packages and compare their checksums, instead of HEAD requests
+  MaxSize     int64		// Larger packages only get a HEAD request
+}
+
+var integrity Integrity
+
+// Entries of repomd.xml
+type RepomdData struct {
+  Type        string  `xml:"type,attr"`
+  Checksum    struct {
+    Type      string  `xml:"type,attr"`
+    Value     string  `xml:",chardata"`
+  } `xml:"checksum"`
+  Location    struct {
+    Href      string  `xml:"href,attr"`
+  } `xml:"location"`
+}
+
+// Package entries of primary.xml
+type PrimaryPackage struct {
+  Checksum    struct {
+    Type      string  `xml:"type,attr"`
+    Value     string  `xml:",chardata"`
+  } `xml:"checksum"`
+  Size        struct {
+    Package   int64   `xml:"package,attr"`
+  } `xml:"size"`
+  Location    struct {
+    Href      string  `xml:"href,attr"`
+  } `xml:"location"`
+}
+
+func integrity_loop () {
+  job_loop(`integrity`, 60 * time.Second, func () {
+    // Only repos which passed their regular check, ISO directories have no package list
+    due := time.Now().Unix() - integrity.Interval
+    tasks := find_tasks("status.result = 200 AND status.integrity_checked < ? AND repos.name NOT LIKE '%isos%' "+
+                        "ORDER BY status.integrity_checked ASC LIMIT ?",
+                        due, 10)
+
+    for _, task := range tasks {
+      if !claim_integrity_check(task, due) { continue }
+
+      // The package downloads run one after the other, so the check takes one of the mirror's slots
+      var result int
+      if !scheduler.Probe(task.Host, func () {
+        log.Printf("Running integrity check on %s\n", task.URL)
+        result = integrity_check(task.URL)
+      }) { return }
+      if result != http.StatusOK && result != 0 { log.Printf("Integrity check on %s failed [%d]\n", task.URL, result) }
+
+      _, err := mirrordb.Exec(`UPDATE status SET integrity = ?, integrity_checked = ? WHERE mirror_id = ? AND repo_id = ?`,
+                              result, time.Now().Unix(), task.MirrorID, task.RepoID)
+      if err != nil { log.Println(err) }
+    }
+  })
+}
+
+// Integrity checks do not use the lease of the status row, which belongs to the regular checks
+// Instead, integrity_checked is set when the check starts, only one instance can move it forward
+// If the instance stops during the check, the row is checked again after the next interval
+func claim_integrity_check (task lib.CheckTask, due int64) (bool) {
+  result, err := mirrordb.Exec(`UPDATE status SET integrity_checked = ? WHERE mirror_id = ? AND repo_id = ? AND integrity_checked < ?`,
+                               time.Now().Unix(), task.MirrorID, task.RepoID, due)
+  if err != nil {
+    log.Println(err)
+    return false
+  }
+
+  // Matching rows are counted on MySQL as well, see lib.Build_DSN
+  claimed, _ := result.RowsAffected()
+  return claimed > 0
+}
+
+// Reads the package list of the repo and checks a random sample of its packages
+// Returns 200 if all are fine, the HTTP code of a missing package or -7 if a package differs from the list
+// 0 means the package list could not be read for reasons other than the mirror (e.g. an unsupported compression)
+func integrity_check (url string) (int) {
+  resp, err := probe_get(url + `/repodata/repomd.xml`)
+  if err != nil { return probe_error_code(err) }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK { return resp.StatusCode }
+
+  var repomd struct {
+    Data      []RepomdData  `xml:"data"`
+  }
+  err = xml.NewDecoder(resp.Body).Decode(&repomd)
+  if err != nil { return -4 }
+
+  var primary *RepomdData
+  for i := range repomd.Data {
+    if repomd.Data[i].Type == `primary` { primary = &repomd.Data[i] }
+  }
+  if primary == nil { return -4 }
+
+  packages, result := primary_sample(url, *primary)
+  if result != http.StatusOK { return result }
+
+  for _, pkg := range packages {
+    result = package_check(url + `/` + pkg.Location.Href, pkg)
+    if result != http.StatusOK { return result }
+  }
+
+  return http.StatusOK
+}
+
+// Downloads primary.xml and picks integrity.Samples packages at random
+func primary_sample (url string, primary RepomdData) ([]PrimaryPackage, int) {
+  var sample []PrimaryPackage
+
+  // Package lists are large, so they get more time than other requests
+  client := long_http_client(300 * time.Second)
+  req, err := http.NewRequest("GET", url + `/` + primary.Location.Href, nil)
+  if err != nil { return sample, -3 }
+  req.Header.Set("User-Agent", useragent)
+  resp, err := probe_do(client, req)
+  if err != nil { return sample, probe_error_code(err) }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK { return sample, resp.StatusCode }
+
+  // The checksum in repomd.xml covers the compressed file
+  var reader io.Reader = resp.Body
+  filehash := new_hash(primary.Checksum.Type)
+  if filehash != nil { reader = io.TeeReader(resp.Body, filehash) }
+
+  var data io.Reader
+  switch {
+    case strings.HasSuffix(primary.Location.Href, `.gz`):
+      gz, gzerr := gzip.NewReader(reader)
+      if gzerr != nil { return sample, -4 }
+      data = gz
+    case strings.HasSuffix(primary.Location.Href, `.bz2`):
+      data = bzip2.NewReader(reader)
+    case strings.HasSuffix(primary.Location.Href, `.xml`):
+      data = reader
+    default:
+      // Other compressions (e.g. xz, zstd) are not supported, which is not the mirror's fault
+      log.Printf("Skipping integrity check on %s, unsupported format of %s\n", url, primary.Location.Href)
+      return sample, 0
+  }
+
+  // Reservoir sampling, as the number of packages is not known in advance
+  var seen int
+  decoder := xml.NewDecoder(data)
+  for {
+    token, err := decoder.Token()
+    if err == io.EOF { break }
+    if err != nil { return sample, -4 }
+
+    start, ok := token.(xml.StartElement)
+    if !ok || start.Name.Local != `package` { continue }
+
+    var pkg PrimaryPackage
+    err = decoder.DecodeElement(&pkg, &start)
+    if err != nil { return sample, -4 }
+    seen++
+
+    if len(sample) < integrity.Samples {
+      sample = append(sample, pkg)
+    } else if i := rand.Intn(seen); i < integrity.Samples {
+      sample[i] = pkg
+    }
+  }
+
+  if filehash != nil {
+    // Read what the XML decoder left, the checksum covers the whole file
+    _, _ = io.Copy(ioutil.Discard, reader)
+    if hex.EncodeToString(filehash.Sum(nil)) != strings.ToLower(strings.TrimSpace(primary.Checksum.Value)) { return sample, -7 }
+  }
+
+  return sample, http.StatusOK
+}
+
+// Checks that the package exists with the listed size and, with integrity.Verify, the listed checksum
+func package_check (url string, pkg PrimaryPackage) (int) {
+  pkghash := new_hash(pkg.Checksum.Type)
+  verify := integrity.Verify && pkghash != nil && pkg.Size.Package <= integrity.MaxSize
+
+  method := "HEAD"
+  if verify { method = "GET" }
+
+  // Downloads take longer than other requests
+  client := long_http_client(300 * time.Second)
+  req, err := http.NewRequest(method, url, nil)
+  if err != nil { return -3 }
+  req.Header.Set("User-Agent", useragent)
+  resp, err := probe_do(client, req)
+  if err != nil { return probe_error_code(err) }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK { return resp.StatusCode }
+
+  if length, err := strconv.ParseInt(resp.Header.Get(`Content-Length`), 10, 64); err == nil && pkg.Size.Package > 0 && length != pkg.Size.Package {
+    log.Printf("Size of %s differs from the package list\n", url)
+    return -7
+  }
+
+  if verify {
+    _, err = io.Copy(pkghash, resp.Body)
+    if err != nil { return probe_error_code(err) }
+    if hex.EncodeToString(pkghash.Sum(nil)) != strings.ToLower(strings.TrimSpace(pkg.Checksum.Value)) {
+      log.Printf("Checksum of %s differs from the package list\n", url)
+      return -7
+    }
+  }
+
+  return http.StatusOK
+}
+
+// Hashes named as in repomd.xml and primary.xml, nil if unknown
+func new_hash (name string) (hash.Hash) {
+  switch name {
+    case `sha`, `sha1`:
+      return sha1.New()
+    case `sha256`:
+      return sha256.New()
+    case `sha512`:
+      return sha512.New()
+  }
+
+  return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import "log"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Jobs which work on all mirrors (HTTPS, rsync, history, ...) only run on one instance at a time
+// Like status rows, each job is leased in the `jobs` table. The lease is renewed while the job runs
+// and released when it is done, so that any instance can run the job once it is due again.
+
+// Runs the job every interval, on whichever instance gets to it first
+func job_loop (name string, interval time.Duration, job func ()) {
+  // Long intervals are not waited for in one go, another instance may have run the job meanwhile
+  pause := interval
+  if pause > 60 * time.Second { pause = 60 * time.Second }
+
+  for {
+    run_job(name, interval, job)
+    time.Sleep(pause)
+  }
+}
+
+// Runs the job if it is due and not leased by another instance
+func run_job (name string, interval time.Duration, job func ()) (bool) {
+  if !claim_job(name, interval) { return false }
+
+  stop := make(chan bool)
+  go renew_job(name, stop)
+  job()
+  close(stop)
+
+  _, err := mirrordb.Exec(`UPDATE jobs SET owner = '', expiry = 0, last_run = ? WHERE name = ? AND owner = ?`,
+                          time.Now().Unix(), name, instance)
+  if err != nil { log.Println(err) }
+
+  return true
+}
+
+func claim_job (name string, interval time.Duration) (bool) {
+  now := time.Now().Unix()
+
+  _, err := mirrordb.Exec(lib.DB_InsertIgnore(dbtype)+" INTO jobs (name) VALUES (?)", name)
+  if err != nil {
+    log.Println(err)
+    return false
+  }
+
+  result, err := mirrordb.Exec(`UPDATE jobs SET owner = ?, expiry = ? WHERE name = ? AND (expiry < ? OR owner = ?) AND last_run <= ?`,
+                               instance, now + leasetime, name, now, instance, now - int64(interval.Seconds()))
+  if err != nil {
+    log.Println(err)
+    return false
+  }
+
+  // Matching rows are counted on MySQL as well, see lib.Build_DSN
+  claimed, _ := result.RowsAffected()
+  return claimed > 0
+}
+
+func renew_job (name string, stop <-chan bool) {
+  ticker := time.NewTicker(time.Duration(leasetime) * time.Second / 3)
+  defer ticker.Stop()
+
+  for {
+    select {
+      case <-stop:
+        return
+      case <-ticker.C:
+        _, err := mirrordb.Exec(`UPDATE jobs SET expiry = ? WHERE name = ? AND owner = ?`,
+                                time.Now().Unix() + leasetime, name, instance)
+        if err != nil { log.Println(err) }
+    }
+  }
+}
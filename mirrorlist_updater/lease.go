@@ -0,0 +1,58 @@
+package main
+
+import "database/sql"
+import "log"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Leases the status rows of the tasks to this instance
+// Rows leased by another instance in the meantime are dropped, only one UPDATE can win
+func claim_tasks (tasks []lib.CheckTask) ([]lib.CheckTask) {
+  var claimed []lib.CheckTask
+  now := time.Now().Unix()
+
+  for _, task := range tasks {
+    var result sql.Result
+    var err error
+    if vantage == `` {
+      result, err = mirrordb.Exec(`UPDATE status SET lease_owner = ?, lease_expiry = ?
+                                   WHERE mirror_id = ? AND repo_id = ? AND (lease_expiry < ? OR lease_owner = ?)`,
+                                  instance, now + leasetime, task.MirrorID, task.RepoID, now, instance)
+    } else {
+      // The row of this vantage may not exist yet
+      _, err = mirrordb.Exec(lib.DB_InsertIgnore(dbtype)+" INTO vantage_status (mirror_id, repo_id, vantage) VALUES (?, ?, ?)",
+                             task.MirrorID, task.RepoID, vantage)
+      if err == nil {
+        result, err = mirrordb.Exec(`UPDATE vantage_status SET lease_owner = ?, lease_expiry = ?
+                                     WHERE mirror_id = ? AND repo_id = ? AND vantage = ? AND (lease_expiry < ? OR lease_owner = ?)`,
+                                    instance, now + leasetime, task.MirrorID, task.RepoID, vantage, now, instance)
+      }
+    }
+    if err != nil {
+      log.Println(err)
+      continue
+    }
+
+    // With clientFoundRows, MySQL also counts a lease renewed within the same second (see lib.Build_DSN)
+    if updated, _ := result.RowsAffected(); updated > 0 {
+      claimed = append(claimed, task)
+    }
+  }
+
+  return claimed
+}
+
+// Gives up the leases of checks which were queued but not run, so that other instances can take them right away
+func release_leases () {
+  table := `status`
+  if vantage != `` { table = `vantage_status` }
+
+  result, err := mirrordb.Exec("UPDATE "+table+" SET lease_owner = '', lease_expiry = 0 WHERE lease_owner = ?", instance)
+  if err != nil {
+    log.Println(err)
+    return
+  }
+
+  if released, _ := result.RowsAffected(); released > 0 { log.Printf("Released %d leases\n", released) }
+}
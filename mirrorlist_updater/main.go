@@ -1,27 +1,59 @@
 package main
 
+import "context"
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "io"
 import "io/ioutil"
 import "log"
 import "math/rand"
 import "net/http"
+import "os"
+import "os/signal"
 import "regexp"
+import "sort"
 import "strconv"
+import "strings"
+import "syscall"
 import "time"
 
 import _ "github.com/mattn/go-sqlite3"
+import "github.com/DavidGamba/go-getoptions"
 import "github.com/jmoiron/sqlx"
 
 import lib "github.com/stevemeier/mirrorlist/lib"
 
 var mirrordb *sqlx.DB
+var dbtype string
 var rescan int
 var useragent string
+var master string
+var master_alt string
+var scheduler *Scheduler
+var publishinterval int64
+var instance string
+var leasetime int64
+var vantage string
+var publishwindow int64
 
 func main() {
   var err error
   resultchan := make(chan lib.CheckResult, 20)
   taskchan := make(chan lib.CheckTask, 20)
 
+  // Command line options, --config is read by lib.Config_path
+  var publish int
+  var publishts int
+  opt := getoptions.New()
+  opt.SetUnknownMode("pass")
+  opt.IntVar(&publish, "publish", 0)
+  opt.IntVar(&publishts, "timestamp", 0)
+  _, err = opt.Parse(os.Args[1:])
+  if err != nil {
+    log.Fatal(err)
+  }
+
   // Read config, file does not have to exists. YAML and JSON are supported
   cfg, loaded := lib.Load_config(lib.Config_path(`mirrorlist_updater.conf`))
   if loaded {
@@ -36,21 +68,171 @@ func main() {
   // Set user-agent
   useragent = cfg.UString(`backend.user-agent`, `mirrorlist_updater.go`)
 
+  // HTTP client for all probes
+  httpsettings.ConnectTimeout = time.Duration(cfg.UInt(`backend.http.connect-timeout`, 5)) * time.Second
+  httpsettings.ReadTimeout = time.Duration(cfg.UInt(`backend.http.read-timeout`, 10)) * time.Second
+  httpsettings.Retries = cfg.UInt(`backend.http.retries`, 1)
+  httpsettings.RetryJitter = time.Duration(cfg.UInt(`backend.http.retry-jitter`, 2000)) * time.Millisecond
+  httpsettings.MaxRedirects = cfg.UInt(`backend.http.max-redirects`, 3)
+  httpsettings.CrossHost = cfg.UBool(`backend.http.cross-host-redirects`, false)
+  httpclient = new_http_client(httpsettings)
+
+  // Several instances can share the checks, each claims rows by a lease
+  // The lease must cover the check and writing its result, or the result is discarded
+  // An empty ID would match rows which are not leased at all, so it gets the default as well
+  hostname, _ := os.Hostname()
+  instance = cfg.UString(`backend.instance-id`, ``)
+  if instance == `` { instance = fmt.Sprintf("%s-%d", hostname, os.Getpid()) }
+  leasetime = int64(cfg.UInt(`backend.lease-duration`, 600))
+  log.Printf("Running as instance %s\n", instance)
+
+  // Instances with a vantage label (e.g. a region) only probe the mirrors and keep their results in `vantage_status`
+  // Everything else is left to the primary instances, which have no label
+  vantage = cfg.UString(`backend.vantage`, ``)
+  if vantage != `` { log.Printf("Probing from vantage %s\n", vantage) }
+
+  // After a publish, mirrors are re-checked every publish-interval seconds until they have the new version
+  publishinterval = int64(cfg.UInt(`backend.publish.interval`, 300))
+  publishwindow = int64(cfg.UInt(`backend.publish.window`, 86400))
+
+  // Reference master, used for repos which have no reference of their own
+  master = strings.TrimSuffix(cfg.UString(`backend.master`, ``), "/")
+  master_alt = strings.TrimSuffix(cfg.UString(`backend.master-altarch`, ``), "/")
+  refinterval := time.Duration(cfg.UInt(`backend.reference-interval`, 300)) * time.Second
+
   // Build DSN from config
   driver, dsn := lib.Build_DSN(cfg)
   log.Printf("Using %s with DSN %s\n", driver, dsn)
 
   // Connect to database
+  dbtype = driver
   mirrordb, err = sqlx.Open(driver, dsn)
   if err != nil {
     log.Fatal(err)
   }
   defer mirrordb.Close()
 
+  // Make sure tables and columns used by the updater exist
+  lib.InitDatabase(mirrordb)
+  _, err = lib.UpgradeDatabase(mirrordb)
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  // Publish a repo and exit (--publish <repo ID> [--timestamp <repomd.xml timestamp>])
+  if publish > 0 {
+    if !publish_repo(publish, int64(publishts)) { os.Exit(1) }
+    return
+  }
+
+  // Discover repositories on the master mirror, if configured
+  if cfg.UString(`backend.discovery.master`, ``) != `` && vantage == `` {
+    var discovery Discovery
+    discovery.Master = cfg.UString(`backend.discovery.master`, ``)
+    discovery.MasterAlt = cfg.UString(`backend.discovery.master-altarch`, ``)
+    discovery.Filelist = cfg.UString(`backend.discovery.filelist`, ``)
+    discovery.Depth = cfg.UInt(`backend.discovery.depth`, 5)
+    discovery.Interval = cfg.UInt(`backend.discovery.interval`, 86400)
+    discovery.Create = cfg.UBool(`backend.discovery.create`, false)
+    if cfg.UString(`backend.discovery.exclude`, ``) != `` {
+      discovery.Exclude, err = regexp.Compile(cfg.UString(`backend.discovery.exclude`, ``))
+      if err != nil {
+        log.Fatal(err)
+      }
+    }
+    go discovery_loop(discovery)
+  }
+
+  // Limit concurrent checks, globally and per mirror host
+  // The probes of tls_loop, rsync_loop, throughput_loop and integrity_loop are limited as well
+  scheduler = NewScheduler(cfg.UInt(`backend.concurrency.global`, 20),
+                            cfg.UInt(`backend.concurrency.per-host`, 2),
+                            time.Duration(cfg.UInt(`backend.concurrency.host-delay`, 1000)) * time.Millisecond)
+
+  // Check HTTPS support and certificates of all mirrors
+  if vantage == `` { go tls_loop() }
+
+  // Auto-disable mirrors after consecutive failures
+  breaker.Failures = cfg.UInt(`backend.breaker.failures`, 10)
+  breaker.Successes = cfg.UInt(`backend.breaker.successes`, 3)
+  breaker.Backoff = int64(cfg.UInt(`backend.breaker.backoff`, 300))
+  breaker.MaxBackoff = int64(cfg.UInt(`backend.breaker.max-backoff`, 86400))
+
+  // Keep every check result, merged into larger intervals as it ages
+  history.Retention = int64(cfg.UInt(`backend.history.retention`, 365)) * 86400
+  history.DownsampleAfter = int64(cfg.UInt(`backend.history.downsample-after`, 7)) * 86400
+  history.Bucket = int64(cfg.UInt(`backend.history.downsample-interval`, 3600))
+  if vantage == `` { go history_loop() }
+
+  // Check rsync support of all mirrors
+  if cfg.UBool(`backend.rsync.enabled`, true) && vantage == `` {
+    rsyncport = cfg.UInt(`backend.rsync.port`, 873)
+    go rsync_loop()
+  }
+
+  // Measure the download speed of each mirror
+  throughput.File = cfg.UString(`backend.throughput.file`, ``)
+  throughput.MaxBytes = int64(cfg.UInt(`backend.throughput.max-bytes`, 10485760))
+  throughput.Timeout = time.Duration(cfg.UInt(`backend.throughput.timeout`, 30)) * time.Second
+  throughput.Interval = int64(cfg.UInt(`backend.throughput.interval`, 86400))
+  if throughput.File != `` && vantage == `` { go throughput_loop() }
+
+  // Spot-check packages of each repo on each mirror
+  integrity.Interval = int64(cfg.UInt(`backend.integrity.interval`, 86400))
+  integrity.Samples = cfg.UInt(`backend.integrity.samples`, 5)
+  integrity.Verify = cfg.UBool(`backend.integrity.verify`, false)
+  integrity.MaxSize = int64(cfg.UInt(`backend.integrity.max-size`, 10485760))
+  if integrity.Samples > 0 && vantage == `` { go integrity_loop() }
+
+  // Local control interface
+  if cfg.UString(`backend.control.listen`, ``) != `` {
+    go control_server(cfg.UString(`backend.control.listen`, ``))
+  }
+
+  // Write check results in batches
+  batch.Size = cfg.UInt(`backend.batch.size`, 20)
+  batch.Interval = time.Duration(cfg.UInt(`backend.batch.interval`, 5)) * time.Second
+  batch.Retries = cfg.UInt(`backend.batch.retries`, 3)
+  batch.Limit = cfg.UInt(`backend.batch.limit`, 1000)
+
+  // Stop on SIGTERM (e.g. systemd) or SIGINT
+  // Checks which have not started yet are simply picked up again after a restart
+  shutdowntimeout := time.Duration(cfg.UInt(`backend.shutdown-timeout`, 30)) * time.Second
+  ctx, cancel := context.WithCancel(context.Background())
+  sigchan := make(chan os.Signal, 1)
+  signal.Notify(sigchan, syscall.SIGTERM, os.Interrupt)
+
   go func() {
+    defer close(taskchan)
+
+    var refchecked time.Time
     for {
-      // Write fresh tasks to the channel, if empty
-      if len(taskchan) == 0 {
+      select {
+        case <-ctx.Done():
+          return
+        default:
+      }
+
+      // New and flagged status rows skip the queue
+      if vantage == `` {
+        var queued int
+        for _, task := range find_priority_checks() {
+          // Checks which are running or not written yet keep their flag, they are checked once more afterwards
+          if !scheduler.AddFirst(task) { continue }
+          clear_priority(task)
+          queued++
+        }
+        if queued > 0 { log.Printf("Queued %d priority checks\n", queued) }
+      }
+
+      // Write fresh tasks to the channel, if empty and the scheduler is not busy
+      if len(taskchan) == 0 && scheduler.Pending() < cap(taskchan) {
+        // The reference is checked first, so that mirrors are compared to current data
+        if time.Since(refchecked) > refinterval && vantage == `` {
+          run_job(`references`, refinterval, check_references)
+          refchecked = time.Now()
+        }
+
         for _, task := range find_next_check(cap(taskchan)) {
             taskchan <- task
         }
@@ -60,37 +242,130 @@ func main() {
   }()
 
   go func() {
-    for {
-      // Watch the queue for new tasks and run them
-      for task := range taskchan {
-	go execute_test(task, resultchan)
-	time.Sleep(100 * time.Millisecond)
-      }
+    // Watch the queue for new tasks and hand them to the scheduler
+    for task := range taskchan {
+      scheduler.Add(task)
     }
   }()
 
+  go scheduler.Run(ctx, execute_test, resultchan)
+
+  // Process check results in batches until shutdown, then write what is left in the queue
+  stopresults := make(chan bool)
+  flushed := make(chan bool)
   go func() {
+    defer close(flushed)
+
+    var results []lib.CheckResult
+    ticker := time.NewTicker(batch.Interval)
+    defer ticker.Stop()
+
     for {
-      // Process check results if the queue is at least half full
-      if len(resultchan) >= cap(resultchan) / 2 {
-        tx, _ := mirrordb.Begin()
-        for result := range resultchan {
-          _ = update_mirror_status(result)
-        }
-        _ = tx.Commit()
+      select {
+        case result := <-resultchan:
+          results = append(results, result)
+          if len(results) >= batch.Size { results = flush_results(results) }
+        case <-ticker.C:
+          results = flush_results(results)
+        case <-stopresults:
+          for len(resultchan) > 0 {
+            results = append(results, <-resultchan)
+          }
+          results = flush_results(results)
+          if len(results) > 0 { log.Printf("Failed to write %d results before shutdown\n", len(results)) }
+          return
       }
-      time.Sleep(100 * time.Millisecond)
     }
   }()
 
-  // Everything is in functions, so we need a loop to keep running
-  // A select loop is safe, a for loop is not
-  select {}
+  sig := <-sigchan
+  log.Printf("Received %s, shutting down\n", sig)
+  cancel()
+
+  if !scheduler.Wait(shutdowntimeout) {
+    log.Printf("Running checks did not finish within %s, their results are lost\n", shutdowntimeout)
+  }
+  close(stopresults)
+  <-flushed
+  release_leases()
+  log.Println("Shutdown complete")
 }
 
+
 func find_next_check (limit int) ([]lib.CheckTask) {
+  // Vantage instances check each repo on each mirror once per rescan interval
+  // Auto-disabled mirrors are left to the primary instances
+  if vantage != `` {
+    return check_tasks("mirrors.auto_disabled = 0 AND COALESCE(vantage_status.checked, 0) < (? - ?) ORDER BY COALESCE(vantage_status.checked, 0) ASC LIMIT ?",
+                       time.Now().Unix(), rescan + rand.Intn(60), limit)
+  }
+
+  // repos to check next
+  // We add a bit of randomness here to distribute load
+  // Mirrors which have not confirmed a recently published version are re-checked more often, and first
+  tasks := check_tasks("mirrors.auto_disabled = 0 AND (checked < (? - ?) OR "+
+                       "(status.timestamp < repos.published AND repos.published_at > ? AND checked < ?)) "+
+                       "ORDER BY CASE WHEN status.timestamp < repos.published THEN 0 ELSE 1 END, status.checked ASC LIMIT ?",
+                       time.Now().Unix(), rescan + rand.Intn(60),
+                       time.Now().Unix() - publishwindow, time.Now().Unix() - publishinterval,
+                       limit)
+
+  // Auto-disabled mirrors are checked with one repo once their backoff has passed
+  // The row stays the least recently checked until its result is written, so the scheduler refuses it meanwhile
+  retries := one_per_mirror(find_tasks("mirrors.auto_disabled > 0 AND mirrors.backoff_until <= ? ORDER BY status.checked ASC LIMIT ?",
+                                       time.Now().Unix(), limit))
+
+  return append(tasks, claim_tasks(retries)...)
+}
+
+// Keeps the first task of each mirror
+func one_per_mirror (tasks []lib.CheckTask) ([]lib.CheckTask) {
+  var result []lib.CheckTask
+  seen := make(map[int]bool)
+
+  for _, task := range tasks {
+    if seen[task.MirrorID] { continue }
+    seen[task.MirrorID] = true
+    result = append(result, task)
+  }
+
+  return result
+}
+
+// Status rows with priority are checked right away, e.g. after a mirror or repo was added
+// The flag is cleared once they are queued
+func find_priority_checks () ([]lib.CheckTask) {
+  return check_tasks("status.priority > 0 ORDER BY status.checked ASC LIMIT ?", 100)
+}
+
+func clear_priority (task lib.CheckTask) {
+  _, err := mirrordb.Exec(`UPDATE status SET priority = 0 WHERE mirror_id = ? AND repo_id = ?`, task.MirrorID, task.RepoID)
+  if err != nil { log.Println(err) }
+}
+
+// Builds check tasks for the status rows matching the condition (and optional ORDER/LIMIT)
+// Rows leased by other instances are skipped, the returned tasks are leased by this instance
+func check_tasks (condition string, args ...interface{}) ([]lib.CheckTask) {
+  // The rows are closed at this point, so that SQLite permits the updates
+  return claim_tasks(find_tasks(condition, args...))
+}
+
+// Same as check_tasks, without leasing the rows
+func find_tasks (condition string, args ...interface{}) ([]lib.CheckTask) {
   var tasks []lib.CheckTask
 
+  // Vantage instances have their own leases in `vantage_status`, shared only with instances of the same vantage
+  leases := `status`
+  join := ``
+  queryargs := []interface{}{}
+  if vantage != `` {
+    leases = `vantage_status`
+    join = "LEFT JOIN vantage_status ON vantage_status.mirror_id = status.mirror_id AND vantage_status.repo_id = status.repo_id "+
+           "AND vantage_status.vantage = ? "
+    queryargs = append(queryargs, vantage)
+  }
+  queryargs = append(queryargs, time.Now().Unix(), time.Now().Unix(), instance)
+
   type SQLresult struct {
     MirrorID    int
     RepoID      int
@@ -102,22 +377,29 @@ func find_next_check (limit int) ([]lib.CheckTask) {
     RepoName    string
     RepoArch    string
     RepoIsAlt   int
+    Timestamp   int64
+    Checksum    string
+    ETag        string
+    LastModified string
   }
 
-  // repos to check next
+  // Releases past their end of life are served from the vault, so their mirrors are not checked
   stmt1, err1 := mirrordb.Prepare("SELECT mirrors.mirror_id, status.repo_id, mirrors.name, mirrors.basedir, mirrors.basedir_altarch, "+
-                                  "repos.major_release, repos.path, repos.name, repos.arch, repos.is_altarch FROM status "+
+                                  "repos.major_release, repos.path, repos.name, repos.arch, repos.is_altarch, "+
+                                  "status.timestamp, status.checksum, status.etag, status.last_modified FROM status "+
                                   "JOIN mirrors ON mirrors.mirror_id = status.mirror_id "+
                                   "JOIN repos ON repos.repo_id = status.repo_id "+
-                                  "WHERE checked < (? - ?) AND repos.enabled > 0 "+
-                                  "ORDER BY status.checked ASC LIMIT ?")
+                                  "LEFT JOIN releases ON releases.major_release = repos.major_release "+join+
+                                  "WHERE repos.enabled > 0 AND (releases.eol IS NULL OR releases.eol = 0 OR releases.eol > ?) "+
+                                  "AND (COALESCE("+leases+".lease_expiry, 0) < ? OR "+leases+".lease_owner = ?) "+
+                                  "AND "+condition)
 
   if err1 != nil {
-    log.Fatal("find_next_check, prepare -> ", err1)
+    log.Fatal("check_tasks, prepare -> ", err1)
   }
+  defer stmt1.Close()
 
-  // We add a bit of randomness here to distribute load
-  rows, err := stmt1.Query(time.Now().Unix(), rescan + rand.Intn(60), limit)
+  rows, err := stmt1.Query(append(queryargs, args...)...)
   if err != nil {
     log.Println(err)
     return tasks
@@ -136,135 +418,232 @@ func find_next_check (limit int) ([]lib.CheckTask) {
                   &result.RepoName,
                   &result.RepoArch,
                   &result.RepoIsAlt,
+                  &result.Timestamp,
+                  &result.Checksum,
+                  &result.ETag,
+                  &result.LastModified,
                   )
 
-    // ISO repositories need special handling
-    iso_re := regexp.MustCompile(`isos`)
-
-    // 8.x has an additional /os subfolder which does not exist for 7.x
-    if result.MRelease == 8 && !iso_re.MatchString(result.RepoName) {
-      result.RepoArch = result.RepoArch+"/os"
-    }
-
     if result.RepoIsAlt > 0 {
       tasks = append(tasks, lib.CheckTask{ MirrorID: result.MirrorID,
                                        RepoID: result.RepoID,
-                                       URL: "http://"+result.Name+result.BasedirAlt+"/"+result.RepoPath+"/"+result.RepoName+"/"+result.RepoArch,
-                                       Iso: iso_re.MatchString(result.RepoName),
+                                       Host: result.Name,
+                                       URL: repo_url("http://"+result.Name+result.BasedirAlt, result.MRelease, result.RepoPath, result.RepoName, result.RepoArch),
+                                       Iso: is_iso(result.RepoName),
 				       AltArch: result.RepoIsAlt > 0,
-                                       Valid: true })
+                                       Valid: true,
+                                       Timestamp: result.Timestamp,
+                                       Checksum: result.Checksum,
+                                       Validators: lib.Validators{ ETag: result.ETag, LastModified: result.LastModified } })
     } else {
       tasks = append(tasks, lib.CheckTask{ MirrorID: result.MirrorID,
                                        RepoID: result.RepoID,
-                                       URL: "http://"+result.Name+result.Basedir+"/"+result.RepoPath+"/"+result.RepoName+"/"+result.RepoArch,
-                                       Iso: iso_re.MatchString(result.RepoName),
+                                       Host: result.Name,
+                                       URL: repo_url("http://"+result.Name+result.Basedir, result.MRelease, result.RepoPath, result.RepoName, result.RepoArch),
+                                       Iso: is_iso(result.RepoName),
 				       AltArch: result.RepoIsAlt > 0,
-                                       Valid: true })
+                                       Valid: true,
+                                       Timestamp: result.Timestamp,
+                                       Checksum: result.Checksum,
+                                       Validators: lib.Validators{ ETag: result.ETag, LastModified: result.LastModified } })
     }
   }
 
   return tasks
 }
 
-func update_mirror_status (cr lib.CheckResult) (bool) {
-  stmt1, err := mirrordb.Prepare(`UPDATE status SET timestamp = ?, checked = ?, result = ? WHERE mirror_id = ? AND repo_id = ?`)
-  if err != nil {
-    log.Print(err)
-    return false
+// ISO repositories need special handling
+func is_iso (name string) (bool) {
+  iso_re := regexp.MustCompile(`isos`)
+  return iso_re.MatchString(name)
+}
+
+func repo_url (base string, release int, path string, name string, arch string) (string) {
+  // 8.x has an additional /os subfolder which does not exist for 7.x
+  if release == 8 && !is_iso(name) {
+    arch = arch+"/os"
   }
 
-  _, err = stmt1.Exec(cr.Timestamp, time.Now().Unix(), cr.Result, cr.MirrorID, cr.RepoID)
-  if err != nil {
-    log.Fatal(err)
-    return false
+  return base+"/"+path+"/"+name+"/"+arch
+}
+
+// Returns false if the row is no longer leased by this instance
+func update_mirror_status (stmt *sqlx.Stmt, cr lib.CheckResult) (bool, error) {
+  result, err := stmt.Exec(cr.Timestamp, cr.Checked, cr.Result, cr.Lag, cr.Behind, cr.Checksum, lib.Bool_to_int(cr.Inconsistent),
+                           cr.Validators.ETag, cr.Validators.LastModified, cr.MirrorID, cr.RepoID, instance)
+  if err != nil { return false, err }
+
+  updated, err := result.RowsAffected()
+  return updated > 0, err
+}
+
+// Reads the checksum file of an ISO directory
+// The timestamp is its Last-Modified header, the checksum covers the listed files and their hashes
+func iso_timestamp (url string, timings *lib.Timings) (int64, int, string) {
+  // 7 has a file sha256sum.txt with checksums, 8 has a file CHECKSUM instead
+  var resp *http.Response
+  var err error
+  for _, file := range []string{`sha256sum.txt`, `CHECKSUM`} {
+    resp, err = probe_get_timed(url + `/` + file, timings, lib.Validators{})
+    if err != nil {
+      return 0, probe_error_code(err), ``
+    }
+    if resp.StatusCode != http.StatusNotFound { break }
+    resp.Body.Close()
   }
+  defer resp.Body.Close()
 
-  return true
+  if resp.StatusCode != http.StatusOK {
+    return 0, resp.StatusCode, ``
+  }
+
+  data, _ := ioutil.ReadAll(resp.Body)
+  checksums := iso_checksums(string(data))
+  if len(checksums) == 0 {
+    return 0, -4, ``
+  }
+
+  // Mirrors syncing with rsync -t keep the modification time of the master
+  var timestamp int64
+  modified, perr := http.ParseTime(resp.Header.Get(`Last-Modified`))
+  if perr == nil { timestamp = modified.Unix() }
+
+  // Signatures and formatting differ between releases, so only the file names and hashes are compared
+  var files []string
+  for file := range checksums { files = append(files, file) }
+  sort.Strings(files)
+  hash := sha256.New()
+  for _, file := range files {
+    _, _ = io.WriteString(hash, file + ` ` + checksums[file] + "\n")
+  }
+
+  return timestamp, resp.StatusCode, hex.EncodeToString(hash.Sum(nil))
 }
 
-func iso_timestamp (url string) (int64, int) {
-  client := &http.Client{Timeout: 5 * time.Second}
+// Parses sha256sum output (`<hash>  <file>`) and BSD style lines (`SHA256 (<file>) = <hash>`)
+// Other lines, like a PGP signature around the list, are ignored
+func iso_checksums (data string) (map[string]string) {
+  result := make(map[string]string)
+  bsdregex := regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-fA-F]{64})$`)
+  gnuregex := regexp.MustCompile(`^([0-9a-fA-F]{64}) [ *](.+)$`)
 
-  // 7 has a file sha256sum.txt with checksums
-  req, _ := http.NewRequest("GET", url + `/sha256sum.txt`, nil)
-  req.Header.Set("User-Agent", useragent)
-  _, err := client.Do(req)
-  if err == nil { return time.Now().Unix(), 200 }
+  for _, line := range strings.Split(data, "\n") {
+    line = strings.TrimSpace(line)
 
-  // 8 has a file CHECKSUM instead
-  req, _ = http.NewRequest("GET", url + `/CHECKSUM`, nil)
-  req.Header.Set("User-Agent", useragent)
-  _, err = client.Do(req)
-  if err == nil { return time.Now().Unix(), 200 }
+    if match := bsdregex.FindStringSubmatch(line); len(match) == 3 {
+      result[match[1]] = strings.ToLower(match[2])
+      continue
+    }
+    if match := gnuregex.FindStringSubmatch(line); len(match) == 3 {
+      result[strings.TrimSpace(match[2])] = strings.ToLower(match[1])
+    }
+  }
 
-  return 0, 404
+  return result
 }
 
-func repository_timestamp (url string) (int64, int) {
+// With validators, repomd.xml is only downloaded if it has changed, otherwise the result is 304
+// The validators are updated from the response, and cleared if the check failed
+func repository_timestamp (url string, timings *lib.Timings, validators *lib.Validators) (int64, int, string) {
   // XML parsing is no fun, so we use a simple regexp instead
   tsregex := regexp.MustCompile(`<timestamp>(\d+)<\/timestamp>`)
 
-  // https://stackoverflow.com/a/13263993
-  // https://medium.com/@nate510/don-t-use-go-s-default-http-client-4804cb19f779
-  client := &http.Client{Timeout: 5 * time.Second}
-  req, err := http.NewRequest("GET", url + `/repodata/repomd.xml`, nil)
-  if err != nil {
-    log.Print(err)
+  var previous lib.Validators
+  if validators != nil {
+    previous = *validators
+    *validators = lib.Validators{}
   }
-  req.Header.Set("User-Agent", useragent)
-  resp, err := client.Do(req)
 
-  // https://stackoverflow.com/a/42718113
+  resp, err := probe_get_timed(url + `/repodata/repomd.xml`, timings, previous)
   if err != nil {
-    nosuchhost, _ := regexp.MatchString(`no such host`, err.Error())
-    timeout, _ := regexp.MatchString(`deadline exceeded`, err.Error())
-
-    if nosuchhost { return 0, -1}
-    if timeout { return 0, -2}
-
-    return 0, -3
+    return 0, probe_error_code(err), ``
   }
   defer resp.Body.Close()
 
+  // Mirrors may leave out the headers on a 304
+  if resp.StatusCode == http.StatusNotModified && validators != nil {
+    *validators = previous
+    if resp.Header.Get(`ETag`) != `` { validators.ETag = resp.Header.Get(`ETag`) }
+    if resp.Header.Get(`Last-Modified`) != `` { validators.LastModified = resp.Header.Get(`Last-Modified`) }
+    return 0, resp.StatusCode, ``
+  }
+
   if resp.StatusCode != http.StatusOK {
-    return 0, resp.StatusCode
+    return 0, resp.StatusCode, ``
   }
 
   data, _ := ioutil.ReadAll(resp.Body)
   timestampstr := tsregex.FindStringSubmatch(string(data))
 
+  // The checksum detects broken syncs which still carry a valid timestamp
+  checksum := sha256.Sum256(data)
+
   if len(timestampstr) == 2 {
     timestampint, converr := strconv.ParseInt(timestampstr[1], 10, 64)
     if converr == nil {
-      return timestampint, resp.StatusCode
+      if validators != nil {
+        validators.ETag = resp.Header.Get(`ETag`)
+        validators.LastModified = resp.Header.Get(`Last-Modified`)
+      }
+      return timestampint, resp.StatusCode, hex.EncodeToString(checksum[:])
     }
   } else {
-    return 0, -4
+    return 0, -4, ``
   }
 
-  return 0, resp.StatusCode
+  return 0, resp.StatusCode, ``
 }
 
-func execute_test (task lib.CheckTask, resultchan chan<- lib.CheckResult) {
+// Returns false if the task was skipped without a result
+func execute_test (task lib.CheckTask) (lib.CheckResult, bool) {
   // Check if task is valid
   if !task.Valid {
     log.Printf("Skipping invalid task on %s\n", task.URL)
-    return
+    return lib.CheckResult{}, false
   }
 
   // Execute check task
   var timestamp int64
   var httpcode int
+  var checksum string
+  validators := task.Validators
+  timings := lib.Timings{ DNS: -1, Connect: -1, TLS: -1, TTFB: -1 }
+  lagknown := true
   log.Printf("Running check on %s\n", task.URL)
+  started := time.Now()
   if (task.Iso) {
     // iso file structure is not a classic repo
-    timestamp, httpcode = iso_timestamp(task.URL)
+    timestamp, httpcode, checksum = iso_timestamp(task.URL, &timings)
+    if httpcode == http.StatusOK {
+      timestamp, httpcode, lagknown = iso_verify(task.RepoID, timestamp, checksum)
+    }
   } else {
     // default repository check, reading repodata/repomd.xml
-    timestamp, httpcode = repository_timestamp(task.URL)
+    timestamp, httpcode, checksum = repository_timestamp(task.URL, &timings, &validators)
+
+    // repomd.xml has not changed since the previous check
+    if httpcode == http.StatusNotModified {
+      timestamp, httpcode, checksum = task.Timestamp, http.StatusOK, task.Checksum
+    }
+  }
+
+  latency := time.Since(started).Milliseconds()
+
+  // Compare with the reference master
+  var lag int64 = -1
+  var behind int = -1
+  var inconsistent bool
+  if httpcode == http.StatusOK {
+    if lagknown { lag, behind = repo_lag(task.RepoID, timestamp) }
+    inconsistent = !repo_consistent(task.RepoID, timestamp, checksum)
+  }
+  if inconsistent {
+    log.Printf("Checksum of %s differs from reference for timestamp %d\n", task.URL, timestamp)
   }
 
-  // Write check result to channel
+  // The scheduler writes the check result to the channel
   log.Printf("Updating status for %s [%d]\n", task.URL, httpcode)
-  resultchan <- lib.CheckResult{ MirrorID: task.MirrorID, RepoID: task.RepoID, Timestamp: timestamp, Result: httpcode }
+  return lib.CheckResult{ MirrorID: task.MirrorID, RepoID: task.RepoID, Timestamp: timestamp, Result: httpcode,
+                          Lag: lag, Behind: behind, Checksum: checksum, Inconsistent: inconsistent,
+                          Checked: started.Unix(), Latency: latency, Timings: timings, Validators: validators }, true
 }
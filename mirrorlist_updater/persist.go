@@ -0,0 +1,107 @@
+package main
+
+import "log"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Settings for writing check results, read from `backend.batch`
+// Results are collected until the batch is full or the interval has passed, then written in one transaction
+type Batch struct {
+  Size        int
+  Interval    time.Duration
+  Retries     int		// Attempts after a failed transaction, before the batch is kept for the next write
+  Limit       int		// Results kept while the database is unavailable, the oldest are dropped beyond that
+}
+
+var batch Batch
+
+// Writes the results and returns those which could not be written
+func flush_results (results []lib.CheckResult) ([]lib.CheckResult) {
+  if len(results) == 0 { return results }
+
+  var err error
+  for attempt := 0; attempt <= batch.Retries; attempt++ {
+    if attempt > 0 { time.Sleep(time.Duration(1 << uint(attempt - 1)) * time.Second) }
+
+    err = save_results(results)
+    if err == nil {
+      scheduler.Saved(results)
+      return results[:0]
+    }
+    log.Printf("Failed to write %d results (attempt %d): %s\n", len(results), attempt + 1, err)
+  }
+
+  if len(results) > batch.Limit {
+    log.Printf("Dropping %d results, which could not be written\n", len(results) - batch.Limit)
+    scheduler.Saved(results[:len(results) - batch.Limit])
+    results = results[len(results) - batch.Limit:]
+  }
+
+  return results
+}
+
+func save_results (results []lib.CheckResult) (error) {
+  if vantage != `` { return save_vantage_results(results) }
+
+  tx, err := mirrordb.Beginx()
+  if err != nil { return err }
+
+  // Results are only written while this instance holds the lease
+  statusstmt, err := tx.Preparex(`UPDATE status SET timestamp = ?, checked = ?, result = ?, lag_seconds = ?, behind = ?, checksum = ?, inconsistent = ?,
+                                  etag = ?, last_modified = ?, lease_owner = '', lease_expiry = 0
+                                  WHERE mirror_id = ? AND repo_id = ? AND lease_owner = ?`)
+  if err != nil {
+    _ = tx.Rollback()
+    return err
+  }
+  defer statusstmt.Close()
+
+  historystmt, err := tx.Preparex(`INSERT INTO status_history (mirror_id, repo_id, checked, result, latency, samples, successes) VALUES (?, ?, ?, ?, ?, 1, ?)`)
+  if err != nil {
+    _ = tx.Rollback()
+    return err
+  }
+  defer historystmt.Close()
+
+  for _, result := range results {
+    leased, err := update_mirror_status(statusstmt, result)
+    if err == nil && !leased {
+      log.Printf("Discarding result for mirror ID %d, repo ID %d, the lease has expired\n", result.MirrorID, result.RepoID)
+      continue
+    }
+    if err == nil { err = add_history(historystmt, result) }
+    if err == nil { err = update_mirror_health(tx, result) }
+    if err == nil { err = update_mirror_timings(tx, result) }
+    if err != nil {
+      _ = tx.Rollback()
+      return err
+    }
+  }
+
+  return tx.Commit()
+}
+
+// Vantage instances only record whether the mirrors are reachable from their location
+func save_vantage_results (results []lib.CheckResult) (error) {
+  tx, err := mirrordb.Beginx()
+  if err != nil { return err }
+
+  stmt, err := tx.Preparex(`UPDATE vantage_status SET timestamp = ?, checked = ?, result = ?, lease_owner = '', lease_expiry = 0
+                            WHERE mirror_id = ? AND repo_id = ? AND vantage = ? AND lease_owner = ?`)
+  if err != nil {
+    _ = tx.Rollback()
+    return err
+  }
+  defer stmt.Close()
+
+  for _, result := range results {
+    _, err = stmt.Exec(result.Timestamp, result.Checked, result.Result, result.MirrorID, result.RepoID, vantage, instance)
+    if err != nil {
+      _ = tx.Rollback()
+      return err
+    }
+  }
+
+  return tx.Commit()
+}
@@ -0,0 +1,62 @@
+package main
+
+import "path/filepath"
+import "testing"
+
+import "github.com/jmoiron/sqlx"
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Creates a fresh database with all columns, as the updater does on startup
+func persist_test_db (t *testing.T) (*sqlx.DB) {
+  dbh, err := sqlx.Open("sqlite3", filepath.Join(t.TempDir(), "mirrorlist.sql"))
+  if err != nil { t.Fatal(err) }
+  t.Cleanup(func () { dbh.Close() })
+
+  if !lib.InitDatabase(dbh) { t.Fatal("InitDatabase failed") }
+  if _, err := lib.UpgradeDatabase(dbh); err != nil { t.Fatal(err) }
+
+  // A second run finds all columns in place
+  added, err := lib.UpgradeDatabase(dbh)
+  if err != nil { t.Fatal(err) }
+  if added != 0 { t.Errorf("second upgrade added %d columns", added) }
+
+  var indexes int
+  if err := dbh.Get(&indexes, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = 'status_history'`); err != nil {
+    t.Fatal(err)
+  }
+  if indexes != 2 { t.Errorf("expected 2 indexes on status_history, got %d", indexes) }
+
+  return dbh
+}
+
+func TestSaveResults (t *testing.T) {
+  mirrordb = persist_test_db(t)
+  instance = "test"
+  vantage = ``
+  breaker = Breaker{ Failures: 3, Successes: 3, Backoff: 60, MaxBackoff: 3600 }
+
+  mirrordb.MustExec(`INSERT INTO mirrors (mirror_id, name, enabled) VALUES (1, 'mirror.example.org', 'yes')`)
+  mirrordb.MustExec(`INSERT INTO repos (repo_id, major_release, path, name, arch, enabled) VALUES (1, 8, 'centos', 'BaseOS', 'x86_64', 1)`)
+  mirrordb.MustExec(`INSERT INTO status (mirror_id, repo_id, lease_owner, lease_expiry) VALUES (1, 1, 'test', 0)`)
+
+  result := lib.CheckResult{ MirrorID: 1, RepoID: 1, Timestamp: 1600000000, Result: 200, Lag: 120, Behind: 2,
+                             Checksum: "abc", Checked: 1600000100, Timings: lib.Timings{ TTFB: -1 } }
+  if err := save_results([]lib.CheckResult{result}); err != nil { t.Fatal(err) }
+
+  var status struct {
+    Timestamp   int64   `db:"timestamp"`
+    Lag         int64   `db:"lag_seconds"`
+    Behind      int     `db:"behind"`
+    Owner       string  `db:"lease_owner"`
+  }
+  if err := mirrordb.Get(&status, `SELECT timestamp, lag_seconds, behind, lease_owner FROM status WHERE mirror_id = 1 AND repo_id = 1`); err != nil {
+    t.Fatal(err)
+  }
+  if status.Timestamp != 1600000000 || status.Lag != 120 || status.Behind != 2 || status.Owner != `` {
+    t.Errorf("status not written: %+v", status)
+  }
+
+  var history int
+  if err := mirrordb.Get(&history, `SELECT COUNT(*) FROM status_history WHERE mirror_id = 1`); err != nil { t.Fatal(err) }
+  if history != 1 { t.Errorf("expected 1 history entry, got %d", history) }
+}
@@ -0,0 +1,179 @@
+package main
+
+import "log"
+import "net/http"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+type RefRepo struct {
+  RepoID      int    `db:"repo_id"`
+  MRelease    int    `db:"major_release"`
+  Path        string `db:"path"`
+  Name        string `db:"name"`
+  Arch        string `db:"arch"`
+  IsAlt       int    `db:"is_altarch"`
+  Reference   string `db:"reference"`
+}
+
+// Reads the current timestamp of each repo from its reference master and records new revisions
+func check_references () {
+  var repos []RefRepo
+  err := mirrordb.Select(&repos, "SELECT repos.repo_id, repos.major_release, repos.path, repos.name, repos.arch, repos.is_altarch, repos.reference FROM repos "+
+                                 "LEFT JOIN releases ON releases.major_release = repos.major_release "+
+                                 "WHERE repos.enabled > 0 AND (releases.eol IS NULL OR releases.eol = 0 OR releases.eol > ?)",
+                                 time.Now().Unix())
+  if err != nil {
+    log.Println(err)
+    return
+  }
+
+  for _, repo := range repos {
+    url := reference_url(repo)
+    if url == `` { continue }
+
+    timestamp, httpcode, checksum := reference_timestamp(repo, url)
+    if httpcode != http.StatusOK {
+      log.Printf("Failed to check reference %s [%d]\n", url, httpcode)
+      continue
+    }
+
+    result, err := mirrordb.Exec(lib.DB_InsertIgnore(dbtype)+" INTO revisions (repo_id, timestamp, seen, checksum) VALUES (?, ?, ?, ?)",
+                                 repo.RepoID, timestamp, time.Now().Unix(), checksum)
+    if err != nil {
+      log.Println(err)
+      continue
+    }
+    if added, _ := result.RowsAffected(); added > 0 {
+      log.Printf("New revision %d of repo ID %d on reference %s\n", timestamp, repo.RepoID, url)
+      continue
+    }
+
+    // Mirrors are compared to the current content of the reference
+    _, err = mirrordb.Exec(`UPDATE revisions SET checksum = ? WHERE repo_id = ? AND timestamp = ?`, checksum, repo.RepoID, timestamp)
+    if err != nil { log.Println(err) }
+  }
+}
+
+// Repos without a reference of their own use the configured master
+func reference_url (repo RefRepo) (string) {
+  if repo.Reference != `` { return repo.Reference }
+
+  base := master
+  if repo.IsAlt > 0 { base = master_alt }
+  if base == `` { return `` }
+
+  return repo_url(base, repo.MRelease, repo.Path, repo.Name, repo.Arch)
+}
+
+func reference_timestamp (repo RefRepo, url string) (int64, int, string) {
+  // ISO directories have no repomd.xml, their checksum file is used instead
+  if is_iso(repo.Name) { return iso_timestamp(url, nil) }
+
+  return repository_timestamp(url, nil, nil)
+}
+
+// Marks a repo as published (--publish <repo ID>), with the timestamp read from its reference unless given
+func publish_repo (repoid int, timestamp int64) (bool) {
+  if timestamp == 0 {
+    var repo RefRepo
+    err := mirrordb.Get(&repo, `SELECT repo_id, major_release, path, name, arch, is_altarch, reference FROM repos WHERE repo_id = ?`, repoid)
+    if err != nil {
+      log.Printf("Failed to read repo ID %d: %s\n", repoid, err)
+      return false
+    }
+
+    url := reference_url(repo)
+    if url == `` {
+      log.Printf("Repo ID %d has no reference, use --timestamp\n", repoid)
+      return false
+    }
+
+    var httpcode int
+    timestamp, httpcode, _ = reference_timestamp(repo, url)
+    if httpcode != http.StatusOK {
+      log.Printf("Failed to check reference %s [%d]\n", url, httpcode)
+      return false
+    }
+  }
+
+  exists, err := lib.PublishRepo(mirrordb, repoid, timestamp)
+  if err != nil {
+    log.Println(err)
+    return false
+  }
+  if !exists {
+    log.Printf("Repo ID %d does not exist\n", repoid)
+    return false
+  }
+
+  log.Printf("Published repo ID %d with timestamp %d\n", repoid, timestamp)
+  return true
+}
+
+// Computes how far a mirror's timestamp is behind the newest revision of the reference
+// Returns the lag in seconds and the number of revisions, -1 for both if there is no reference data
+func repo_lag (repoid int, timestamp int64) (int64, int) {
+  var revisions int
+  var newer int
+  var newest int64
+
+  row := mirrordb.QueryRow(`SELECT COUNT(*), COALESCE(SUM(CASE WHEN timestamp > ? THEN 1 ELSE 0 END), 0), COALESCE(MAX(timestamp), 0)
+                            FROM revisions WHERE repo_id = ?`, timestamp, repoid)
+  err := row.Scan(&revisions, &newer, &newest)
+  if err != nil {
+    log.Println(err)
+    return -1, -1
+  }
+
+  if revisions == 0 { return -1, -1 }
+  if newer == 0 { return 0, 0 }
+  return newest - timestamp, newer
+}
+
+// Compares the checksum of a mirror's repomd.xml with the reference's for the same timestamp
+// Returns true if they match or if the reference has no checksum for this timestamp
+func repo_consistent (repoid int, timestamp int64, checksum string) (bool) {
+  var reference string
+
+  row := mirrordb.QueryRow(`SELECT checksum FROM revisions WHERE repo_id = ? AND timestamp = ?`, repoid, timestamp)
+  err := row.Scan(&reference)
+  if err != nil { return true }
+
+  return reference == `` || reference == checksum
+}
+
+// Compares the checksum file of an ISO mirror with the revisions of the reference
+// Returns the timestamp of the matching revision and 200, or -6 if the reference had different files for the same timestamp
+// The last value is false if the lag cannot be computed, e.g. for ISO sets older than the recorded revisions
+func iso_verify (repoid int, timestamp int64, checksum string) (int64, int, bool) {
+  var revisions []struct {
+    Timestamp   int64  `db:"timestamp"`
+    Checksum    string `db:"checksum"`
+  }
+
+  err := mirrordb.Select(&revisions, `SELECT timestamp, checksum FROM revisions WHERE repo_id = ? ORDER BY timestamp DESC`, repoid)
+  if err != nil {
+    log.Println(err)
+    return timestamp, http.StatusOK, false
+  }
+
+  // Without reference data there is nothing to compare
+  if len(revisions) == 0 { return timestamp, http.StatusOK, true }
+
+  // Mirrors which do not preserve modification times are matched by content
+  for _, revision := range revisions {
+    if revision.Checksum == checksum { return revision.Timestamp, http.StatusOK, true }
+  }
+
+  // The reference may not have been checked since its last update
+  if timestamp > revisions[0].Timestamp { return timestamp, http.StatusOK, true }
+
+  // Only files which differ from the reference's for the same timestamp are an error, like repo_consistent does for repomd.xml
+  // Anything else may be a set from before the revisions were recorded, or a mirror without Last-Modified
+  for _, revision := range revisions {
+    if revision.Timestamp == timestamp && revision.Checksum != `` { return timestamp, -6, true }
+  }
+
+  return timestamp, http.StatusOK, false
+}
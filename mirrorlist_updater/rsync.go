@@ -0,0 +1,317 @@
+package main
+
+import "bufio"
+import "encoding/binary"
+import "errors"
+import "io"
+import "log"
+import "net"
+import "strconv"
+import "strings"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// rsync daemon protocol, see https://rsync.samba.org/how-rsync-works.html
+// Protocol 29 is the newest version without varint encoding, all daemons since rsync 2.6.4 support it
+const rsync_protocol = 29
+
+// Flags of file list entries (flist.c)
+const (
+  xmit_same_mode      = 1 << 1
+  xmit_extended_flags = 1 << 2
+  xmit_same_name      = 1 << 5
+  xmit_long_name      = 1 << 6
+  xmit_same_time      = 1 << 7
+)
+
+// Offset of message tags in the multiplexed stream (io.c)
+const rsync_mplex_base = 7
+
+var rsyncport int
+
+type RsyncEntry struct {
+  Name        string
+  Size        int64
+  Mtime       int64
+  Mode        uint32
+}
+
+func rsync_loop () {
+  job_loop(`rsync`, 60 * time.Second, func () {
+    for _, mirror := range find_next_rsync_check() {
+      var available bool
+      if !scheduler.Probe(mirror.Name, func () {
+        log.Printf("Running rsync check on %s\n", mirror.Name)
+        available = rsync_check_mirror(mirror)
+      }) { return }
+
+      _, err := mirrordb.Exec(`UPDATE mirrors SET rsync = ?, rsync_checked = ? WHERE mirror_id = ?`,
+                              lib.Bool_to_int(available), time.Now().Unix(), mirror.ID)
+      if err != nil { log.Println(err) }
+    }
+  })
+}
+
+func find_next_rsync_check () ([]lib.Mirror) {
+  var mirrors []lib.Mirror
+
+  err := mirrordb.Select(&mirrors, `SELECT mirror_id, name, basedir, basedir_altarch, rsync_path, rsync_path_altarch FROM mirrors
+                                    WHERE rsync_checked < ? ORDER BY rsync_checked ASC`,
+                         time.Now().Unix() - int64(rescan))
+  if err != nil { log.Println(err) }
+
+  return mirrors
+}
+
+// Lists repomd.xml of each repo on the mirror via rsync and stores the result per repo
+// Returns true if at least one repo is available via rsync
+func rsync_check_mirror (mirror lib.Mirror) (bool) {
+  var available bool
+
+  type SQLresult struct {
+    RepoID      int    `db:"repo_id"`
+    MRelease    int    `db:"major_release"`
+    Path        string `db:"path"`
+    Name        string `db:"name"`
+    Arch        string `db:"arch"`
+    IsAlt       int    `db:"is_altarch"`
+  }
+
+  var repos []SQLresult
+  err := mirrordb.Select(&repos, "SELECT repos.repo_id, repos.major_release, repos.path, repos.name, repos.arch, repos.is_altarch FROM status "+
+                                 "JOIN repos ON repos.repo_id = status.repo_id "+
+                                 "LEFT JOIN releases ON releases.major_release = repos.major_release "+
+                                 "WHERE status.mirror_id = ? AND repos.enabled > 0 "+
+                                 "AND (releases.eol IS NULL OR releases.eol = 0 OR releases.eol > ?)",
+                                 mirror.ID, time.Now().Unix())
+  if err != nil {
+    log.Println(err)
+    return false
+  }
+
+  // rsync uses the host name only, the port is configured separately
+  host, _, err := net.SplitHostPort(mirror.Name)
+  if err != nil { host = mirror.Name }
+
+  for _, repo := range repos {
+    // The rsync path starts with the module, by default it is the same as the HTTP base directory
+    base := mirror.RsyncPath
+    if base == `` { base = mirror.Basedir }
+    if repo.IsAlt > 0 {
+      base = mirror.RsyncPathAlt
+      if base == `` { base = mirror.BasedirAlt }
+    }
+    if strings.Trim(base, "/") == `` { continue }
+
+    path := repo_url(strings.Trim(base, "/"), repo.MRelease, repo.Path, repo.Name, repo.Arch)
+    if !is_iso(repo.Name) {
+      path += "/repodata/repomd.xml"
+    }
+
+    var timestamp int64
+    entries, result := rsync_list(host, path)
+    if result == 200 && len(entries) > 0 {
+      timestamp = entries[0].Mtime
+      available = true
+    }
+    log.Printf("Updating rsync status for rsync://%s/%s [%d]\n", host, path, result)
+
+    _, err = mirrordb.Exec(`UPDATE status SET rsync_timestamp = ?, rsync_result = ? WHERE mirror_id = ? AND repo_id = ?`,
+                           timestamp, result, mirror.ID, repo.RepoID)
+    if err != nil { log.Println(err) }
+  }
+
+  return available
+}
+
+// Lists a path (module/path) on an rsync daemon
+// The result codes follow repository_timestamp: 200 if found, 404 if not, negative values for connection errors
+func rsync_list (host string, path string) ([]RsyncEntry, int) {
+  var entries []RsyncEntry
+
+  conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(rsyncport)), httpsettings.ConnectTimeout)
+  if err != nil {
+    if strings.Contains(err.Error(), "no such host") { return entries, -1 }
+    if strings.Contains(err.Error(), "timeout") { return entries, -2 }
+    return entries, -3
+  }
+  defer conn.Close()
+  _ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+  reader := bufio.NewReader(conn)
+  module := strings.SplitN(path, "/", 2)[0]
+
+  // Handshake and module selection are line based
+  result := rsync_handshake(conn, reader, module)
+  if result != 200 { return entries, result }
+
+  // The daemon runs an rsync server with these arguments, which sends the file list
+  // -d lists the path itself instead of recursing into it
+  for _, arg := range []string{"--server", "--sender", "-d", ".", path, ""} {
+    _, err = io.WriteString(conn, arg+"\n")
+    if err != nil { return entries, -3 }
+  }
+
+  // Checksum seed, not needed for listing
+  var seed int32
+  err = binary.Read(reader, binary.LittleEndian, &seed)
+  if err != nil { return entries, -3 }
+
+  // Empty filter list
+  err = binary.Write(conn, binary.LittleEndian, int32(0))
+  if err != nil { return entries, -3 }
+
+  demux := &RsyncDemux{reader: reader}
+  entries, err = rsync_read_filelist(demux)
+  if err != nil {
+    log.Printf("Failed to read rsync file list of %s: %s\n", path, err)
+    return entries, -3
+  }
+
+  if len(entries) == 0 {
+    if len(demux.messages) > 0 { log.Printf("rsync://%s/%s: %s\n", host, path, strings.TrimSpace(demux.messages[0])) }
+    return entries, 404
+  }
+
+  return entries, 200
+}
+
+// Exchanges protocol versions and selects the module
+func rsync_handshake (conn net.Conn, reader *bufio.Reader, module string) (int) {
+  greeting, err := reader.ReadString('\n')
+  if err != nil || !strings.HasPrefix(greeting, "@RSYNCD: ") { return -3 }
+
+  _, err = io.WriteString(conn, "@RSYNCD: "+strconv.Itoa(rsync_protocol)+".0\n")
+  if err != nil { return -3 }
+
+  _, err = io.WriteString(conn, module+"\n")
+  if err != nil { return -3 }
+
+  // The daemon may send a message of the day before the response
+  for {
+    line, err := reader.ReadString('\n')
+    if err != nil { return -3 }
+    line = strings.TrimSpace(line)
+
+    switch {
+      case line == `@RSYNCD: OK`:
+        return 200
+      case strings.HasPrefix(line, `@RSYNCD: AUTHREQD`):
+        return 401
+      case strings.HasPrefix(line, `@ERROR`), line == `@RSYNCD: EXIT`:
+        log.Printf("rsync module %s: %s\n", module, line)
+        return 404
+    }
+  }
+}
+
+// Reads the data part of the multiplexed stream sent by the daemon, messages are collected separately
+type RsyncDemux struct {
+  reader      *bufio.Reader
+  remaining   int
+  messages    []string
+}
+
+func (d *RsyncDemux) Read (p []byte) (int, error) {
+  for d.remaining == 0 {
+    var header uint32
+    err := binary.Read(d.reader, binary.LittleEndian, &header)
+    if err != nil { return 0, err }
+
+    tag := int(header >> 24) - rsync_mplex_base
+    length := int(header & 0xFFFFFF)
+
+    if tag == 0 {
+      d.remaining = length
+      continue
+    }
+
+    // Everything else is a message (errors, warnings, info)
+    message := make([]byte, length)
+    _, err = io.ReadFull(d.reader, message)
+    if err != nil { return 0, err }
+    d.messages = append(d.messages, string(message))
+  }
+
+  if len(p) > d.remaining { p = p[:d.remaining] }
+  n, err := d.reader.Read(p)
+  d.remaining -= n
+  return n, err
+}
+
+func rsync_read_filelist (r io.Reader) ([]RsyncEntry, error) {
+  var entries []RsyncEntry
+  var last RsyncEntry
+
+  readbyte := func () (int, error) {
+    b := make([]byte, 1)
+    _, err := io.ReadFull(r, b)
+    return int(b[0]), err
+  }
+  readint := func () (int32, error) {
+    var v int32
+    err := binary.Read(r, binary.LittleEndian, &v)
+    return v, err
+  }
+
+  for {
+    flags, err := readbyte()
+    if err != nil { return entries, err }
+
+    // A zero byte ends the list
+    if flags == 0 { return entries, nil }
+
+    if flags & xmit_extended_flags > 0 {
+      high, err := readbyte()
+      if err != nil { return entries, err }
+      flags |= high << 8
+    }
+
+    // Names are sent as difference to the previous name
+    var samelen int
+    if flags & xmit_same_name > 0 {
+      samelen, err = readbyte()
+      if err != nil { return entries, err }
+    }
+    var namelen int
+    if flags & xmit_long_name > 0 {
+      length, err := readint()
+      if err != nil { return entries, err }
+      namelen = int(length)
+    } else {
+      namelen, err = readbyte()
+      if err != nil { return entries, err }
+    }
+    if samelen > len(last.Name) || namelen < 0 { return entries, errors.New("invalid file name length") }
+    name := make([]byte, namelen)
+    _, err = io.ReadFull(r, name)
+    if err != nil { return entries, err }
+
+    entry := RsyncEntry{ Name: last.Name[:samelen] + string(name), Mtime: last.Mtime, Mode: last.Mode }
+
+    // Sizes above 2 GB are sent as -1 followed by 64 bits
+    size, err := readint()
+    if err != nil { return entries, err }
+    entry.Size = int64(size)
+    if size == -1 {
+      err = binary.Read(r, binary.LittleEndian, &entry.Size)
+      if err != nil { return entries, err }
+    }
+
+    if flags & xmit_same_time == 0 {
+      mtime, err := readint()
+      if err != nil { return entries, err }
+      entry.Mtime = int64(mtime)
+    }
+
+    if flags & xmit_same_mode == 0 {
+      mode, err := readint()
+      if err != nil { return entries, err }
+      entry.Mode = uint32(mode)
+    }
+
+    entries = append(entries, entry)
+    last = entry
+  }
+}
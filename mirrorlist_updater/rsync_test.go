@@ -0,0 +1,156 @@
+package main
+
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "io/ioutil"
+import "net"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "testing"
+import "time"
+
+// Builds a file list in the format of protocol 29, as sent by rsync --server --sender
+func rsync_test_filelist () ([]byte) {
+  var list bytes.Buffer
+  le := func (v interface{}) { _ = binary.Write(&list, binary.LittleEndian, v) }
+
+  // repodata/repomd.xml, with its own time and mode
+  // Flags of 0 are sent as two bytes with xmit_extended_flags, as 0 ends the list
+  list.WriteByte(xmit_extended_flags)
+  list.WriteByte(0)
+  list.WriteByte(byte(len("repodata/repomd.xml")))
+  list.WriteString("repodata/repomd.xml")
+  le(int32(3086))
+  le(int32(1600000000))
+  le(int32(0100644))
+
+  // repodata/primary.xml.gz, sharing the first 9 bytes of the name, the time and the mode
+  list.WriteByte(xmit_same_name | xmit_same_time | xmit_same_mode)
+  list.WriteByte(9)
+  list.WriteByte(byte(len("primary.xml.gz")))
+  list.WriteString("primary.xml.gz")
+  le(int32(1234567))
+
+  // A long name and a size above 2 GB
+  longname := string(bytes.Repeat([]byte("a"), 300))
+  list.WriteByte(xmit_long_name | xmit_same_mode)
+  le(int32(len(longname)))
+  list.WriteString(longname)
+  le(int32(-1))
+  le(int64(5000000000))
+  le(int32(1700000000))
+
+  // End of list
+  list.WriteByte(0)
+
+  return list.Bytes()
+}
+
+// Wraps data in multiplexed frames, split in two with a message in between
+func rsync_test_multiplex (data []byte, message string) ([]byte) {
+  var stream bytes.Buffer
+  frame := func (tag int, payload []byte) {
+    _ = binary.Write(&stream, binary.LittleEndian, uint32((tag + rsync_mplex_base) << 24 | len(payload)))
+    stream.Write(payload)
+  }
+
+  half := len(data) / 2
+  frame(0, data[:half])
+  frame(2, []byte(message))
+  frame(0, data[half:])
+
+  return stream.Bytes()
+}
+
+func TestRsyncReadFilelist (t *testing.T) {
+  stream := rsync_test_multiplex(rsync_test_filelist(), "rsync: some warning\n")
+  demux := &RsyncDemux{reader: bufio.NewReader(bytes.NewReader(stream))}
+
+  entries, err := rsync_read_filelist(demux)
+  if err != nil { t.Fatalf("rsync_read_filelist failed: %s", err) }
+
+  expected := []RsyncEntry{
+    { Name: "repodata/repomd.xml", Size: 3086, Mtime: 1600000000, Mode: 0100644 },
+    { Name: "repodata/primary.xml.gz", Size: 1234567, Mtime: 1600000000, Mode: 0100644 },
+    { Name: string(bytes.Repeat([]byte("a"), 300)), Size: 5000000000, Mtime: 1700000000, Mode: 0100644 },
+  }
+  if len(entries) != len(expected) { t.Fatalf("got %d entries, expected %d", len(entries), len(expected)) }
+  for i := range expected {
+    if entries[i] != expected[i] { t.Errorf("entry %d: got %+v, expected %+v", i, entries[i], expected[i]) }
+  }
+
+  if len(demux.messages) != 1 || demux.messages[0] != "rsync: some warning\n" {
+    t.Errorf("unexpected messages %q", demux.messages)
+  }
+}
+
+func TestRsyncReadFilelistTruncated (t *testing.T) {
+  list := rsync_test_filelist()
+  _, err := rsync_read_filelist(bytes.NewReader(list[:len(list) - 10]))
+  if err == nil { t.Error("expected an error for a truncated list") }
+}
+
+// Runs rsync_list against a local rsync daemon, skipped if rsync is not installed
+func TestRsyncList (t *testing.T) {
+  rsyncbin, err := exec.LookPath("rsync")
+  if err != nil { t.Skip("rsync is not installed") }
+
+  dir := t.TempDir()
+  module := filepath.Join(dir, "module")
+  err = os.MkdirAll(filepath.Join(module, "repodata"), 0755)
+  if err != nil { t.Fatal(err) }
+  err = ioutil.WriteFile(filepath.Join(module, "repodata", "repomd.xml"), []byte("<repomd/>"), 0644)
+  if err != nil { t.Fatal(err) }
+  mtime := time.Unix(1600000000, 0)
+  err = os.Chtimes(filepath.Join(module, "repodata", "repomd.xml"), mtime, mtime)
+  if err != nil { t.Fatal(err) }
+
+  // Pick a free port
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil { t.Fatal(err) }
+  port := listener.Addr().(*net.TCPAddr).Port
+  listener.Close()
+
+  config := fmt.Sprintf("use chroot = no\npid file = %s\n[test]\npath = %s\nread only = yes\n",
+                        filepath.Join(dir, "rsyncd.pid"), module)
+  if os.Getuid() == 0 { config = "uid = 0\ngid = 0\n" + config }
+  err = ioutil.WriteFile(filepath.Join(dir, "rsyncd.conf"), []byte(config), 0644)
+  if err != nil { t.Fatal(err) }
+
+  daemon := exec.Command(rsyncbin, "--daemon", "--no-detach", "--address=127.0.0.1", fmt.Sprintf("--port=%d", port),
+                         "--config="+filepath.Join(dir, "rsyncd.conf"))
+  err = daemon.Start()
+  if err != nil { t.Fatal(err) }
+  defer func () {
+    _ = daemon.Process.Kill()
+    _ = daemon.Wait()
+  }()
+
+  // Wait for the daemon to listen
+  for i := 0; i < 50; i++ {
+    conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+    if err == nil {
+      conn.Close()
+      break
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+
+  rsyncport = port
+  httpsettings.ConnectTimeout = 5 * time.Second
+
+  entries, result := rsync_list("127.0.0.1", "test/repodata/repomd.xml")
+  if result != 200 { t.Fatalf("got result %d for an existing file", result) }
+  if len(entries) != 1 || entries[0].Name != "repomd.xml" || entries[0].Mtime != 1600000000 || entries[0].Size != 9 {
+    t.Errorf("unexpected entries %+v", entries)
+  }
+
+  _, result = rsync_list("127.0.0.1", "test/repodata/missing.xml")
+  if result != 404 { t.Errorf("got result %d for a missing file", result) }
+
+  _, result = rsync_list("127.0.0.1", "nomodule/repodata/repomd.xml")
+  if result != 404 { t.Errorf("got result %d for a missing module", result) }
+}
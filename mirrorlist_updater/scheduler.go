@@ -0,0 +1,241 @@
+package main
+
+import "context"
+import "fmt"
+import "sync"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Runs check tasks while limiting concurrency, globally and per mirror host
+// Checks on the same host are spaced by a configurable delay, to be polite to volunteer mirrors
+type Scheduler struct {
+  global      int
+  perhost     int
+  delay       time.Duration
+
+  mutex       sync.Mutex
+  pending     []lib.CheckTask
+  inflight    map[string]lib.CheckTask
+  hostcount   map[string]int
+  hostlast    map[string]time.Time
+  unsaved     map[string]bool		// Finished, but the result is not in the database yet
+  probing     int			// Probes outside of the queue (TLS, rsync, ...), see Probe
+  paused      bool
+
+  running     sync.WaitGroup
+  stopped     chan bool
+}
+
+func NewScheduler (global int, perhost int, delay time.Duration) (*Scheduler) {
+  return &Scheduler{ global: global,
+                     perhost: perhost,
+                     delay: delay,
+                     inflight: make(map[string]lib.CheckTask),
+                     hostcount: make(map[string]int),
+                     hostlast: make(map[string]time.Time),
+                     unsaved: make(map[string]bool),
+                     stopped: make(chan bool) }
+}
+
+func task_key (task lib.CheckTask) (string) {
+  return fmt.Sprintf("%d/%d", task.MirrorID, task.RepoID)
+}
+
+// Queues a task, unless the same check is queued or running already
+func (s *Scheduler) Add (task lib.CheckTask) (bool) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  if _, running := s.inflight[task_key(task)]; running { return false }
+  if s.unsaved[task_key(task)] { return false }
+  for _, queued := range s.pending {
+    if task_key(queued) == task_key(task) { return false }
+  }
+
+  s.pending = append(s.pending, task)
+  return true
+}
+
+// Queues a task in front of all others, or moves it there if it is queued already
+func (s *Scheduler) AddFirst (task lib.CheckTask) (bool) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  if _, running := s.inflight[task_key(task)]; running { return false }
+  if s.unsaved[task_key(task)] { return false }
+
+  pending := []lib.CheckTask{task}
+  for _, queued := range s.pending {
+    if task_key(queued) != task_key(task) { pending = append(pending, queued) }
+  }
+  s.pending = pending
+
+  return true
+}
+
+func (s *Scheduler) Pending () (int) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  return len(s.pending)
+}
+
+// Copy of the queued tasks, in order
+func (s *Scheduler) Queued () ([]lib.CheckTask) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  return append([]lib.CheckTask{}, s.pending...)
+}
+
+func (s *Scheduler) InFlight () ([]lib.CheckTask) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  tasks := []lib.CheckTask{}
+  for _, task := range s.inflight { tasks = append(tasks, task) }
+  return tasks
+}
+
+// While paused, queued tasks are kept but not started
+func (s *Scheduler) Pause (paused bool) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  s.paused = paused
+}
+
+func (s *Scheduler) Paused () (bool) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  return s.paused
+}
+
+// Starts queued tasks as limits permit, until the context is cancelled
+// Results are sent once the task is marked as unsaved, so that Saved always comes after it
+func (s *Scheduler) Run (ctx context.Context, run func(lib.CheckTask) (lib.CheckResult, bool), results chan<- lib.CheckResult) {
+  defer close(s.stopped)
+
+  for {
+    select {
+      case <-ctx.Done():
+        return
+      case <-time.After(50 * time.Millisecond):
+    }
+
+    for _, task := range s.next() {
+      s.running.Add(1)
+      go func (task lib.CheckTask) {
+        defer s.running.Done()
+        result, ok := run(task)
+        s.done(task, ok)
+        if ok { results <- result }
+      }(task)
+    }
+  }
+}
+
+// Waits for Run to stop and for running tasks to finish
+// Returns false if they did not finish within the timeout
+func (s *Scheduler) Wait (timeout time.Duration) (bool) {
+  finished := make(chan bool)
+  go func() {
+    <-s.stopped
+    s.running.Wait()
+    close(finished)
+  }()
+
+  select {
+    case <-finished:
+      return true
+    case <-time.After(timeout):
+      return false
+  }
+}
+
+// Takes all tasks from the queue which may start now
+func (s *Scheduler) next () ([]lib.CheckTask) {
+  var start []lib.CheckTask
+
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  if s.paused { return start }
+
+  var remaining []lib.CheckTask
+  for _, task := range s.pending {
+    if s.free(task.Host) {
+      s.inflight[task_key(task)] = task
+      s.hostcount[task.Host]++
+      s.hostlast[task.Host] = time.Now()
+      start = append(start, task)
+    } else {
+      remaining = append(remaining, task)
+    }
+  }
+  s.pending = remaining
+
+  return start
+}
+
+// Whether another request to the host may start now, called with the mutex held
+func (s *Scheduler) free (host string) (bool) {
+  return len(s.inflight) + s.probing < s.global &&
+         s.hostcount[host] < s.perhost &&
+         time.Since(s.hostlast[host]) >= s.delay
+}
+
+// Tasks without a result have nothing to wait for, they may be queued again right away
+func (s *Scheduler) done (task lib.CheckTask, unsaved bool) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  delete(s.inflight, task_key(task))
+  if unsaved { s.unsaved[task_key(task)] = true }
+  s.release(task.Host)
+}
+
+func (s *Scheduler) release (host string) {
+  s.hostcount[host]--
+  if s.hostcount[host] <= 0 { delete(s.hostcount, host) }
+}
+
+// Runs a probe which is not a queued check (TLS, rsync, throughput, integrity) within the same limits
+// Blocks until the host is free, returns false without running the probe once the scheduler has stopped
+func (s *Scheduler) Probe (host string, probe func ()) (bool) {
+  for {
+    s.mutex.Lock()
+    if !s.paused && s.free(host) {
+      s.probing++
+      s.hostcount[host]++
+      s.hostlast[host] = time.Now()
+      s.mutex.Unlock()
+      break
+    }
+    s.mutex.Unlock()
+
+    select {
+      case <-s.stopped:
+        return false
+      case <-time.After(50 * time.Millisecond):
+    }
+  }
+
+  defer func () {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.probing--
+    s.release(host)
+  }()
+
+  probe()
+  return true
+}
+
+// Called once results are written (or given up), so that their checks may be queued again
+func (s *Scheduler) Saved (results []lib.CheckResult) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+
+  for _, result := range results {
+    delete(s.unsaved, task_key(lib.CheckTask{ MirrorID: result.MirrorID, RepoID: result.RepoID }))
+  }
+}
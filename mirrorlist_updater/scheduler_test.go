@@ -0,0 +1,78 @@
+package main
+
+import "context"
+import "sync"
+import "testing"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Probes and queued checks share the per-host limit
+func TestSchedulerProbe (t *testing.T) {
+  s := NewScheduler(10, 1, 0)
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+
+  var mutex sync.Mutex
+  var running, highest int
+  enter := func () {
+    mutex.Lock()
+    running++
+    if running > highest { highest = running }
+    mutex.Unlock()
+    time.Sleep(100 * time.Millisecond)
+    mutex.Lock()
+    running--
+    mutex.Unlock()
+  }
+
+  s.Add(lib.CheckTask{ MirrorID: 1, RepoID: 1, Host: "mirror.example.org" })
+  go s.Run(ctx, func (task lib.CheckTask) (lib.CheckResult, bool) {
+    enter()
+    return lib.CheckResult{}, false
+  }, make(chan lib.CheckResult, 1))
+
+  var wg sync.WaitGroup
+  for i := 0; i < 3; i++ {
+    wg.Add(1)
+    go func () {
+      defer wg.Done()
+      if !s.Probe("mirror.example.org", enter) { t.Error("probe did not run") }
+    }()
+  }
+  wg.Wait()
+
+  mutex.Lock()
+  defer mutex.Unlock()
+  if highest != 1 { t.Errorf("%d requests ran on the same host at once, limit is 1", highest) }
+}
+
+// Once the scheduler has stopped, probes are not run any more
+func TestSchedulerProbeStopped (t *testing.T) {
+  s := NewScheduler(10, 1, 0)
+  ctx, cancel := context.WithCancel(context.Background())
+  go s.Run(ctx, func (task lib.CheckTask) (lib.CheckResult, bool) { return lib.CheckResult{}, false }, nil)
+  s.Pause(true)
+  cancel()
+
+  if s.Probe("mirror.example.org", func () { t.Error("probe ran after the scheduler stopped") }) {
+    t.Error("Probe returned true")
+  }
+}
+
+// A result saved as soon as it is received must not leave the task refused
+func TestSchedulerSavedBeforeDone (t *testing.T) {
+  s := NewScheduler(10, 1, 0)
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+
+  task := lib.CheckTask{ MirrorID: 1, RepoID: 1, Host: "mirror.example.org" }
+  results := make(chan lib.CheckResult)
+  s.Add(task)
+  go s.Run(ctx, func (task lib.CheckTask) (lib.CheckResult, bool) {
+    return lib.CheckResult{ MirrorID: task.MirrorID, RepoID: task.RepoID }, true
+  }, results)
+
+  s.Saved([]lib.CheckResult{<-results})
+  if !s.Add(task) { t.Error("task refused after its result was saved") }
+}
@@ -0,0 +1,98 @@
+package main
+
+import "io"
+import "io/ioutil"
+import "log"
+import "net/http"
+import "strings"
+import "time"
+
+import "github.com/jmoiron/sqlx"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Settings for the throughput test, read from `backend.throughput`
+type Throughput struct {
+  File        string		// Path below the mirror's basedir, the test is disabled if empty
+  MaxBytes    int64		// The download stops after this many bytes
+  Timeout     time.Duration
+  Interval    int64		// Seconds between two tests of the same mirror
+}
+
+var throughput Throughput
+
+// Keeps the timings of the last probe which got a response
+// DNS, connect and TLS are only measured on new connections, otherwise the previous values are kept
+func update_mirror_timings (tx *sqlx.Tx, cr lib.CheckResult) (error) {
+  if cr.Timings.TTFB < 0 { return nil }
+
+  _, err := tx.Exec(`UPDATE mirrors SET dns_time = CASE WHEN ? < 0 THEN dns_time ELSE ? END,
+                                        connect_time = CASE WHEN ? < 0 THEN connect_time ELSE ? END,
+                                        tls_time = CASE WHEN ? < 0 THEN tls_time ELSE ? END,
+                                        ttfb = ?, timings_checked = ?
+                     WHERE mirror_id = ?`,
+                    cr.Timings.DNS, cr.Timings.DNS, cr.Timings.Connect, cr.Timings.Connect, cr.Timings.TLS, cr.Timings.TLS,
+                    cr.Timings.TTFB, cr.Checked, cr.MirrorID)
+  return err
+}
+
+func throughput_loop () {
+  job_loop(`throughput`, 60 * time.Second, func () {
+    for _, mirror := range find_next_throughput_check() {
+      url := "http://"+mirror.Name+strings.TrimSuffix(mirror.Basedir, "/")+"/"+strings.TrimPrefix(throughput.File, "/")
+      var result int64
+      if !scheduler.Probe(mirror.Name, func () {
+        log.Printf("Running throughput test on %s\n", url)
+        result = throughput_probe(url)
+      }) { return }
+
+      _, err := mirrordb.Exec(`UPDATE mirrors SET throughput = ?, throughput_checked = ? WHERE mirror_id = ?`,
+                              result, time.Now().Unix(), mirror.ID)
+      if err != nil { log.Println(err) }
+    }
+  })
+}
+
+func find_next_throughput_check () ([]lib.Mirror) {
+  var mirrors []lib.Mirror
+
+  err := mirrordb.Select(&mirrors, `SELECT mirror_id, name, basedir FROM mirrors
+                                    WHERE enabled > 0 AND auto_disabled = 0 AND throughput_checked < ? ORDER BY throughput_checked ASC`,
+                         time.Now().Unix() - throughput.Interval)
+  if err != nil { log.Println(err) }
+
+  return mirrors
+}
+
+// Downloads up to MaxBytes of the file and returns the bytes per second, 0 if the download failed
+func throughput_probe (url string) (int64) {
+  // Downloads take longer than other requests
+  client := long_http_client(throughput.Timeout)
+  req, err := http.NewRequest("GET", url, nil)
+  if err != nil {
+    log.Print(err)
+    return 0
+  }
+  req.Header.Set("User-Agent", useragent)
+  resp, err := client.Do(req)
+  if err != nil {
+    log.Printf("Throughput test on %s failed: %s\n", url, err)
+    return 0
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK {
+    log.Printf("Throughput test on %s failed [%d]\n", url, resp.StatusCode)
+    return 0
+  }
+
+  // Only the transfer counts, a slow response is already covered by the TTFB
+  // A download cut short by the timeout still tells how fast the mirror is
+  started := time.Now()
+  read, err := io.CopyN(ioutil.Discard, resp.Body, throughput.MaxBytes)
+  elapsed := time.Since(started).Milliseconds()
+  if err != nil && err != io.EOF { log.Printf("Throughput test on %s stopped after %d bytes: %s\n", url, read, err) }
+  if elapsed < 1 { elapsed = 1 }
+
+  return read * 1000 / elapsed
+}
@@ -0,0 +1,91 @@
+package main
+
+import "crypto/tls"
+import "log"
+import "net"
+import "strings"
+import "time"
+
+import lib "github.com/stevemeier/mirrorlist/lib"
+
+// Names of TLS versions, as stored in the database
+var tlsversions = map[uint16]string{
+  tls.VersionTLS10: `TLS 1.0`,
+  tls.VersionTLS11: `TLS 1.1`,
+  tls.VersionTLS12: `TLS 1.2`,
+  tls.VersionTLS13: `TLS 1.3`,
+}
+
+// Connection failures (e.g. timeouts) in a row, before the https flag is cleared
+// Certificate errors clear it right away
+const tlsfailures = 3
+
+type TLSResult struct {
+  Valid       bool
+  Version     string
+  Expiry      int64
+  Error       string	// Certificate problems only, mirrors without HTTPS have no error
+}
+
+func tls_loop () {
+  job_loop(`tls`, 60 * time.Second, func () {
+    for _, mirror := range find_next_tls_check() {
+      // Like regular checks, the probe waits for the mirror's concurrency limit
+      var result TLSResult
+      if !scheduler.Probe(mirror.Name, func () {
+        log.Printf("Running HTTPS check on %s\n", mirror.Name)
+        result = tls_probe(mirror.Name)
+      }) { return }
+
+      var err error
+      if result.Valid || result.Error != `` {
+        _, err = mirrordb.Exec(`UPDATE mirrors SET https = ?, tls_version = ?, cert_expiry = ?, tls_error = ?, tls_checked = ?, tls_failures = 0 WHERE mirror_id = ?`,
+                               lib.Bool_to_int(result.Valid), result.Version, result.Expiry, result.Error, time.Now().Unix(), mirror.ID)
+      } else {
+        // A single failed connection may be a network problem, so the flag is kept until it happens repeatedly
+        // MySQL assigns from left to right, so https is set before tls_failures changes
+        _, err = mirrordb.Exec(`UPDATE mirrors SET https = CASE WHEN tls_failures + 1 >= ? THEN 0 ELSE https END,
+                                                   tls_failures = tls_failures + 1, tls_checked = ? WHERE mirror_id = ?`,
+                               tlsfailures, time.Now().Unix(), mirror.ID)
+      }
+      if err != nil { log.Println(err) }
+    }
+  })
+}
+
+func find_next_tls_check () ([]lib.Mirror) {
+  var mirrors []lib.Mirror
+
+  err := mirrordb.Select(&mirrors, `SELECT mirror_id, name FROM mirrors WHERE tls_checked < ? ORDER BY tls_checked ASC`,
+                         time.Now().Unix() - int64(rescan))
+  if err != nil { log.Println(err) }
+
+  return mirrors
+}
+
+// Connects to port 443 and validates the certificate chain and hostname
+func tls_probe (name string) (TLSResult) {
+  var result TLSResult
+
+  // Mirrors may be configured with a port, HTTPS always uses 443
+  host, _, err := net.SplitHostPort(name)
+  if err != nil { host = name }
+
+  dialer := &net.Dialer{Timeout: httpsettings.ConnectTimeout}
+  conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, "443"), &tls.Config{ServerName: host})
+  if err != nil {
+    if strings.Contains(err.Error(), "x509") { result.Error = err.Error() }
+    log.Printf("HTTPS check on %s failed: %s\n", name, err)
+    return result
+  }
+  defer conn.Close()
+
+  state := conn.ConnectionState()
+  result.Valid = true
+  result.Version = tlsversions[state.Version]
+  if len(state.PeerCertificates) > 0 {
+    result.Expiry = state.PeerCertificates[0].NotAfter.Unix()
+  }
+
+  return result
+}